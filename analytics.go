@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultStatsRange is how far back stats go when no 'from' is given
+const defaultStatsRange = 30 * 24 * time.Hour
+
+// maxStatsBuckets stops someone asking for ten years of hourly clicks
+const maxStatsBuckets = 5000
+
+// defaultVariant is how clicks that went to the longUrl show up in the variants breakdown
+const defaultVariant = "(default)"
+
+// unknownCountry is clicks with no country, because the IP wasn't found or there is no GeoIP database
+const unknownCountry = "(unknown)"
+
+// Stats intervals
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+	IntervalWeek = "week"
+)
+
+// LinkAnalytics is the click summary of one link over a date range
+type LinkAnalytics struct {
+	ShortUrl  string        `json:"shortUrl"`
+	Title     string        `json:"title"`
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Interval  string        `json:"interval"`
+	Clicks    int           `json:"clicks"`
+	Series    []ClickBucket `json:"series"`
+	Referrers []ClickCount  `json:"referrers"`
+	Browsers  []ClickCount  `json:"browsers"`
+	OS        []ClickCount  `json:"os"`
+	Devices   []ClickCount  `json:"devices"`
+	Countries []ClickCount  `json:"countries"`
+	Variants  []ClickCount  `json:"variants"`
+}
+
+// ClickBucket is the number of clicks in the interval starting at Start
+type ClickBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+// ClickCount is the number of clicks for one value of a breakdown, eg a referrer domain
+type ClickCount struct {
+	Name   string `json:"name"`
+	Clicks int    `json:"clicks"`
+}
+
+// StatsJSONHandler responds with the click analytics for a link
+func StatsJSONHandler(w http.ResponseWriter, r *http.Request) {
+
+	la, status, err := linkAnalytics(r)
+	if err != nil {
+		writeJSON(w, status, APIResponse{err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, la)
+}
+
+// StatsHTMLHandler shows the click analytics for a link in an HTML template
+func StatsHTMLHandler(w http.ResponseWriter, r *http.Request) {
+
+	la, _, err := linkAnalytics(r)
+	if err != nil {
+		tpl.ExecuteTemplate(w, "error", err.Error())
+		return
+	}
+
+	// Set up some page data
+	pageData := make(map[string]interface{})
+	pageData["Title"] = fmt.Sprintf("Stats for /%s", la.ShortUrl)
+	pageData["Heading"] = fmt.Sprintf("Clicks on /%s", la.ShortUrl)
+	pageData["BaseUrl"] = os.Getenv("LINKR_BASE_URL")
+	pageData["Stats"] = la
+
+	// Serve it up
+	err = tpl.ExecuteTemplate(w, "stats", pageData)
+	if err != nil {
+		log.Printf("template execution: %s", err)
+	}
+}
+
+// linkAnalytics looks up the link in the path and summarises its clicks over the range in the query
+// string - from and to (RFC 3339 or yyyy-mm-dd) and interval (hour, day or week). On error it also
+// returns a suitable status code.
+func linkAnalytics(r *http.Request) (LinkAnalytics, int, error) {
+
+	la := LinkAnalytics{}
+	sUrl := mux.Vars(r)["shortUrl"]
+
+	ld, err := Store.FindLink(sUrl)
+	if err == ErrNotFound {
+		return la, http.StatusNotFound, fmt.Errorf("The link /%s could not be found in the database.", sUrl)
+	}
+	if err != nil {
+		return la, http.StatusInternalServerError, err
+	}
+
+	q := r.URL.Query()
+	la.ShortUrl = ld.ShortUrl
+	la.Title = ld.Title
+	la.Interval = q.Get("interval")
+	if la.Interval == "" {
+		la.Interval = IntervalDay
+	}
+	if la.Interval != IntervalHour && la.Interval != IntervalDay && la.Interval != IntervalWeek {
+		return la, http.StatusBadRequest, errors.New("interval must be one of hour, day or week")
+	}
+
+	la.To = time.Now().UTC()
+	if s := q.Get("to"); s != "" {
+		la.To, err = parseStatsTime(s, true)
+		if err != nil {
+			return la, http.StatusBadRequest, err
+		}
+	}
+	la.From = la.To.Add(-defaultStatsRange)
+	if s := q.Get("from"); s != "" {
+		la.From, err = parseStatsTime(s, false)
+		if err != nil {
+			return la, http.StatusBadRequest, err
+		}
+	}
+	if !la.From.Before(la.To) {
+		return la, http.StatusBadRequest, errors.New("from must be before to")
+	}
+	if la.To.Sub(la.From)/intervalDuration(la.Interval) > maxStatsBuckets {
+		return la, http.StatusBadRequest, fmt.Errorf("Too many %ss in that range, try a longer interval", la.Interval)
+	}
+
+	groups, err := Store.ClickCounts(ld.ID, la.From, la.To, la.Interval)
+	if err != nil {
+		return la, http.StatusInternalServerError, err
+	}
+
+	la.summarise(groups)
+
+	return la, http.StatusOK, nil
+}
+
+// summarise fills in the totals, time series and breakdowns from the click counts
+func (la *LinkAnalytics) summarise(groups []ClickGroup) {
+
+	// Every bucket in the range is present, even with no clicks, so that charts don't skip gaps
+	buckets := make(map[time.Time]int)
+	for t := truncateInterval(la.From, la.Interval); t.Before(la.To); t = addInterval(t, la.Interval) {
+		buckets[t] = 0
+		la.Series = append(la.Series, ClickBucket{Start: t})
+	}
+
+	referrers := make(map[string]int)
+	browsers := make(map[string]int)
+	oss := make(map[string]int)
+	devices := make(map[string]int)
+	countries := make(map[string]int)
+	variants := make(map[string]int)
+
+	for _, g := range groups {
+		la.Clicks += g.Clicks
+		buckets[truncateInterval(g.Start, la.Interval)] += g.Clicks
+		referrers[referrerDomain(g.Referrer)] += g.Clicks
+
+		ua := ParseUserAgent(g.Agent)
+		browsers[ua.Browser] += g.Clicks
+		oss[ua.OS] += g.Clicks
+		devices[ua.Device] += g.Clicks
+
+		if g.Country == "" {
+			countries[unknownCountry] += g.Clicks
+		} else {
+			countries[g.Country] += g.Clicks
+		}
+
+		if g.Variant == "" {
+			variants[defaultVariant] += g.Clicks
+		} else {
+			variants[g.Variant] += g.Clicks
+		}
+	}
+
+	for i := range la.Series {
+		la.Series[i].Clicks = buckets[la.Series[i].Start]
+	}
+	la.Referrers = sortedCounts(referrers)
+	la.Browsers = sortedCounts(browsers)
+	la.OS = sortedCounts(oss)
+	la.Devices = sortedCounts(devices)
+	la.Countries = sortedCounts(countries)
+	la.Variants = sortedCounts(variants)
+}
+
+// parseStatsTime accepts RFC 3339 or a plain date. A plain date 'to' includes the whole of that day.
+func parseStatsTime(s string, end bool) (time.Time, error) {
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err = time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("Could not understand the date '%s', use yyyy-mm-dd or RFC 3339", s)
+	}
+	if end {
+		t = t.Add(24 * time.Hour)
+	}
+
+	return t, nil
+}
+
+// truncateInterval returns the start of the interval containing t, in UTC. Weeks start on Monday.
+func truncateInterval(t time.Time, interval string) time.Time {
+
+	t = t.UTC()
+	switch interval {
+	case IntervalHour:
+		return t.Truncate(time.Hour)
+	case IntervalWeek:
+		d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// addInterval returns the start of the interval after the one starting at t
+func addInterval(t time.Time, interval string) time.Time {
+
+	switch interval {
+	case IntervalHour:
+		return t.Add(time.Hour)
+	case IntervalWeek:
+		return t.AddDate(0, 0, 7)
+	}
+
+	return t.AddDate(0, 0, 1)
+}
+
+func intervalDuration(interval string) time.Duration {
+
+	switch interval {
+	case IntervalHour:
+		return time.Hour
+	case IntervalWeek:
+		return 7 * 24 * time.Hour
+	}
+
+	return 24 * time.Hour
+}
+
+// referrerDomain reduces a referrer to its host, without any www.
+func referrerDomain(ref string) string {
+
+	if ref == "" {
+		return "(direct)"
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return "(unknown)"
+	}
+
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// sortedCounts turns a map of counts into a list, most clicks first
+func sortedCounts(m map[string]int) []ClickCount {
+
+	cs := make([]ClickCount, 0, len(m))
+	for k, v := range m {
+		cs = append(cs, ClickCount{Name: k, Clicks: v})
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Clicks != cs[j].Clicks {
+			return cs[i].Clicks > cs[j].Clicks
+		}
+		return cs[i].Name < cs[j].Name
+	})
+
+	return cs
+}
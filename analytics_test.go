@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTruncateInterval(t *testing.T) {
+
+	nz := time.FixedZone("NZDT", 13*60*60)
+	for _, c := range []struct {
+		t        time.Time
+		interval string
+		want     string
+	}{
+		{time.Date(2024, 1, 3, 10, 59, 59, 0, time.UTC), IntervalHour, "2024-01-03T10:00:00Z"},
+		{time.Date(2024, 1, 3, 10, 59, 59, 0, time.UTC), IntervalDay, "2024-01-03T00:00:00Z"},
+		{time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC), IntervalWeek, "2024-01-01T00:00:00Z"},
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), IntervalWeek, "2024-01-01T00:00:00Z"},
+		{time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC), IntervalWeek, "2024-01-01T00:00:00Z"},
+		{time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), IntervalWeek, "2024-01-08T00:00:00Z"},
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), IntervalWeek, "2024-02-26T00:00:00Z"},
+
+		// In UTC whatever the zone of t
+		{time.Date(2024, 1, 4, 9, 0, 0, 0, nz), IntervalDay, "2024-01-03T00:00:00Z"},
+		{time.Date(2024, 1, 8, 9, 0, 0, 0, nz), IntervalWeek, "2024-01-01T00:00:00Z"},
+	} {
+		if got := truncateInterval(c.t, c.interval).Format(time.RFC3339); got != c.want {
+			t.Errorf("%s by %s: %s, want %s", c.t, c.interval, got, c.want)
+		}
+	}
+}
+
+func TestParseStatsTime(t *testing.T) {
+
+	for _, c := range []struct {
+		s    string
+		end  bool
+		want string
+	}{
+		{"2024-01-03", false, "2024-01-03T00:00:00Z"},
+		{"2024-01-03", true, "2024-01-04T00:00:00Z"},
+		{"2024-01-03T10:00:00+13:00", true, "2024-01-02T21:00:00Z"},
+	} {
+		got, err := parseStatsTime(c.s, c.end)
+		if err != nil || got.Format(time.RFC3339) != c.want {
+			t.Errorf("%s: %s, %v, want %s", c.s, got, err, c.want)
+		}
+	}
+
+	if _, err := parseStatsTime("3 Jan", false); err == nil {
+		t.Error("3 Jan: no error")
+	}
+}
+
+func TestReferrerDomain(t *testing.T) {
+
+	for ref, want := range map[string]string{
+		"":                               "(direct)",
+		"https://www.Example.org/a?b=c":  "example.org",
+		"http://news.example.org:8080/x": "news.example.org",
+		"android-app://com.example":      "com.example",
+		"not a url":                      "(unknown)",
+	} {
+		if got := referrerDomain(ref); got != want {
+			t.Errorf("%q: %q, want %q", ref, got, want)
+		}
+	}
+}
+
+func TestSummarise(t *testing.T) {
+
+	id := bson.NewObjectId()
+	m := NewMemoryStore()
+	at := func(s string) time.Time {
+		t, _ := time.Parse(time.RFC3339, s)
+		return t
+	}
+	for _, s := range []LinkStatsDoc{
+		{CreatedAt: at("2024-01-01T09:00:00Z"), Referrer: "https://www.example.org/", Country: "NZ"},
+		{CreatedAt: at("2024-01-01T23:59:59Z"), Referrer: "https://example.org/a", Country: "NZ", Variant: "b"},
+		{CreatedAt: at("2024-01-03T00:00:00Z")},
+		{CreatedAt: at("2024-01-03T12:00:00Z"), Referrer: "https://other.example/", Country: "AU"},
+
+		// Outside the range, or another link's
+		{CreatedAt: at("2023-12-31T23:59:59Z")},
+		{CreatedAt: at("2024-01-04T00:00:00Z")},
+		{CreatedAt: at("2024-01-02T00:00:00Z"), LinkID: bson.NewObjectId()},
+	} {
+		if s.LinkID == "" {
+			s.LinkID = id
+		}
+		m.RecordStats(s)
+	}
+
+	la := LinkAnalytics{From: at("2024-01-01T00:00:00Z"), To: at("2024-01-04T00:00:00Z"), Interval: IntervalDay}
+	groups, _ := m.ClickCounts(id, la.From, la.To, la.Interval)
+	if len(groups) != 4 {
+		t.Errorf("%v groups, want 4", len(groups))
+	}
+	la.summarise(groups)
+
+	if la.Clicks != 4 {
+		t.Errorf("clicks = %v, want 4", la.Clicks)
+	}
+	series := []ClickBucket{
+		{at("2024-01-01T00:00:00Z"), 2},
+		{at("2024-01-02T00:00:00Z"), 0},
+		{at("2024-01-03T00:00:00Z"), 2},
+	}
+	if !reflect.DeepEqual(la.Series, series) {
+		t.Errorf("series = %v, want %v", la.Series, series)
+	}
+	for name, c := range map[string]struct{ got, want []ClickCount }{
+		"referrers": {la.Referrers, []ClickCount{{"example.org", 2}, {"(direct)", 1}, {"other.example", 1}}},
+		"countries": {la.Countries, []ClickCount{{"NZ", 2}, {"(unknown)", 1}, {"AU", 1}}},
+		"variants":  {la.Variants, []ClickCount{{"(default)", 3}, {"b", 1}}},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %v, want %v", name, c.got, c.want)
+		}
+	}
+
+	// Clicks with the same details in the same interval are one group
+	m.RecordStats(LinkStatsDoc{LinkID: id, CreatedAt: at("2024-01-03T18:00:00Z")})
+	groups, _ = m.ClickCounts(id, la.From, la.To, la.Interval)
+	if len(groups) != 4 {
+		t.Errorf("%v groups after another click, want 4", len(groups))
+	}
+
+	// Weekly buckets start on the Monday before from, and the range now takes in the click on the 4th
+	la = LinkAnalytics{From: at("2024-01-03T00:00:00Z"), To: at("2024-01-10T00:00:00Z"), Interval: IntervalWeek}
+	groups, _ = m.ClickCounts(id, la.From, la.To, la.Interval)
+	la.summarise(groups)
+	series = []ClickBucket{{at("2024-01-01T00:00:00Z"), 4}, {at("2024-01-08T00:00:00Z"), 0}}
+	if !reflect.DeepEqual(la.Series, series) {
+		t.Errorf("weekly series = %v, want %v", la.Series, series)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		serve("POST", "/api/links", `{"shortUrl": "s", "longUrl": "https://example.org/"}`)
+		serve("GET", "/s", "")
+		waitForClicks(t, "s", 1)
+
+		w := serve("GET", "/s/stats.json?interval=hour&from="+time.Now().UTC().Add(-3*time.Hour).Format(time.RFC3339), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %v, %s", w.Code, w.Body)
+		}
+		la := LinkAnalytics{}
+		json.NewDecoder(w.Body).Decode(&la)
+		if la.Clicks != 1 || len(la.Series) != 4 || la.Series[3].Clicks != 1 {
+			t.Errorf("stats = %+v", la)
+		}
+
+		for _, q := range []string{"interval=month", "from=2024-01-02&to=2024-01-01", "from=2000-01-01&interval=hour", "to=x"} {
+			if w = serve("GET", "/s/stats.json?"+q, ""); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: status %v, want %v", q, w.Code, http.StatusBadRequest)
+			}
+		}
+	})
+}
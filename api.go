@@ -0,0 +1,521 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxShortUrlLength keeps slugs to something a person might actually type
+const maxShortUrlLength = 64
+
+// validShortUrl matches the characters allowed in a slug
+var validShortUrl = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedShortUrls are path segments used by linkr itself
+var reservedShortUrls = map[string]bool{
+	"api": true,
+}
+
+// linkBody is the body of a create or update request, a LinkDoc plus the plain text password if one is being set
+type linkBody struct {
+	LinkDoc
+	Password OptionalPassword `json:"password"`
+}
+
+// APIAuth wraps h so that it requires the LINKR_API_KEY as a bearer token.
+// If LINKR_API_KEY is not set the API is disabled.
+func APIAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := os.Getenv("LINKR_API_KEY")
+		if key == "" {
+			writeJSON(w, http.StatusForbidden, APIResponse{"The API is disabled - LINKR_API_KEY is not set"})
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="linkr"`)
+			writeJSON(w, http.StatusUnauthorized, APIResponse{"Invalid or missing API key"})
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// CreateLinkHandler adds a new link from a JSON body in the same shape as a LinkDoc
+func CreateLinkHandler(w http.ResponseWriter, r *http.Request) {
+
+	lb := linkBody{LinkDoc: LinkDoc{Active: true}}
+	err := json.NewDecoder(r.Body).Decode(&lb)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"Could not decode request body: " + err.Error()})
+		return
+	}
+	ld := lb.LinkDoc
+
+	if ld.LongUrl == "" {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"longUrl is required"})
+		return
+	}
+
+	// Fields the server looks after start afresh, whatever was sent
+	now := time.Now()
+	keepServerFields(&ld, LinkDoc{ID: bson.NewObjectId(), CreatedAt: now})
+	ld.UpdatedAt = now
+
+	err = setPassword(&ld, lb.Password)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	err = setNamespace(&ld)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	// Check the rest of the link before spending any short codes on it
+	err = validateLinkSettings(ld)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	// No vanity slug so generate one
+	if ld.ShortUrl == "" {
+		ld, err = addGeneratedLink(ld)
+		if err != nil {
+			log.Printf("Error adding link: %s", err)
+			writeJSON(w, http.StatusInternalServerError, APIResponse{"Error adding link: " + err.Error()})
+			return
+		}
+		w.Header().Set("Location", "/api/links/"+ld.ShortUrl)
+		writeJSON(w, http.StatusCreated, apiLink(ld))
+		return
+	}
+
+	err = validateLink(ld)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	err = Store.AddLink(ld)
+	if err == ErrDuplicateLink {
+		writeJSON(w, http.StatusConflict, APIResponse{fmt.Sprintf("The link /%s already exists", ld.ShortUrl)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error adding link"})
+		return
+	}
+
+	w.Header().Set("Location", "/api/links/"+ld.ShortUrl)
+	writeJSON(w, http.StatusCreated, apiLink(ld))
+}
+
+// UpdateLinkHandler changes the fields of an existing link that are present in the JSON body.
+// A field sent as null is cleared.
+func UpdateLinkHandler(w http.ResponseWriter, r *http.Request) {
+
+	sUrl := mux.Vars(r)["shortUrl"]
+
+	old, err := Store.FindLink(sUrl)
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, APIResponse{fmt.Sprintf("The link /%s could not be found", sUrl)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding link"})
+		return
+	}
+
+	// Decoding over the existing doc only changes the fields in the body, so the result can be validated as a whole
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"Could not read request body: " + err.Error()})
+		return
+	}
+	lb := linkBody{LinkDoc: old}
+	err = clearReplacedFields(&lb.LinkDoc, body)
+	if err == nil {
+		err = json.Unmarshal(body, &lb)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"Could not decode request body: " + err.Error()})
+		return
+	}
+	ld := lb.LinkDoc
+	keepServerFields(&ld, old)
+
+	err = setPassword(&ld, lb.Password)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	err = setNamespace(&ld)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	// New target so the old status no longer applies
+	if ld.LongUrl != old.LongUrl {
+		resetCheckState(&ld)
+	}
+
+	err = validateLink(ld)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{err.Error()})
+		return
+	}
+
+	ld.UpdatedAt = time.Now()
+	ld, err = Store.UpdateLink(sUrl, ld)
+	if err == ErrDuplicateLink {
+		writeJSON(w, http.StatusConflict, APIResponse{fmt.Sprintf("The link /%s already exists", ld.ShortUrl)})
+		return
+	}
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, APIResponse{fmt.Sprintf("The link /%s could not be found", sUrl)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error updating link"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiLink(ld))
+}
+
+// clearReplacedFields sets the pointer, slice and map fields of ld that are present in the JSON body to nil.
+// encoding/json decodes into whatever is already there, so a new list of targets or schedule, or map of languages,
+// would otherwise be merged over the old one.
+func clearReplacedFields(ld *LinkDoc, body []byte) error {
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(ld).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := fields[name]; !ok {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+
+	return nil
+}
+
+// keepServerFields copies the fields that only linkr itself changes from src to ld,
+// so they can't be set through the API
+func keepServerFields(ld *LinkDoc, src LinkDoc) {
+
+	ld.ID = src.ID
+	ld.CreatedAt = src.CreatedAt
+	ld.Clicks = src.Clicks
+	ld.LastStatusCode = src.LastStatusCode
+	ld.LastErrorClass = src.LastErrorClass
+	ld.LastError = src.LastError
+	ld.MovedTo = src.MovedTo
+	ld.LastCheckedAt = src.LastCheckedAt
+	ld.NextCheckAt = src.NextCheckAt
+	ld.CheckFailures = src.CheckFailures
+	ld.PasswordHash = src.PasswordHash
+}
+
+// resetCheckState clears the outcome of the last check, for a link with a new long url, so that it is checked afresh
+func resetCheckState(ld *LinkDoc) {
+
+	ld.LastStatusCode = 0
+	ld.LastErrorClass = ""
+	ld.LastError = ""
+	ld.MovedTo = ""
+	ld.LastCheckedAt = time.Time{}
+	ld.NextCheckAt = time.Time{}
+	ld.CheckFailures = 0
+}
+
+// setPassword hashes a new password onto ld, or removes the password if it was sent as null
+func setPassword(ld *LinkDoc, p OptionalPassword) error {
+
+	if !p.Set {
+		return nil
+	}
+	if p.Value == nil {
+		ld.PasswordHash = ""
+		return nil
+	}
+	if *p.Value == "" {
+		return ErrEmptyPassword
+	}
+
+	h, err := HashPassword(*p.Value)
+	if err != nil {
+		return err
+	}
+	ld.PasswordHash = h
+
+	return nil
+}
+
+// apiLink is ld as returned by the API, without the password hash
+func apiLink(ld LinkDoc) LinkDoc {
+
+	ld.PasswordHash = ""
+
+	return ld
+}
+
+// DeleteLinkHandler removes a link, responding with the doc that was deleted
+func DeleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+
+	sUrl := mux.Vars(r)["shortUrl"]
+
+	ld, err := Store.FindLink(sUrl)
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, APIResponse{fmt.Sprintf("The link /%s could not be found", sUrl)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding link"})
+		return
+	}
+
+	err = Store.DeleteLink(sUrl)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error deleting link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error deleting link"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiLink(ld))
+}
+
+// MovedJSONHandler lists the links whose long url permanently redirects somewhere else, most clicked first
+func MovedJSONHandler(w http.ResponseWriter, r *http.Request) {
+
+	ld, err := Store.Moved()
+	if err != nil {
+		log.Printf("Error finding moved links: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding moved links"})
+		return
+	}
+
+	for i := range ld {
+		ld[i] = apiLink(ld[i])
+	}
+
+	writeJSON(w, http.StatusOK, ld)
+}
+
+// AcceptMovedHandler makes the url a link has moved to its long url, so visitors skip the old one's redirects
+func AcceptMovedHandler(w http.ResponseWriter, r *http.Request) {
+
+	sUrl := mux.Vars(r)["shortUrl"]
+
+	ld, err := Store.FindLink(sUrl)
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, APIResponse{fmt.Sprintf("The link /%s could not be found", sUrl)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding link"})
+		return
+	}
+
+	if ld.MovedTo == "" {
+		writeJSON(w, http.StatusConflict, APIResponse{fmt.Sprintf("The link /%s has not moved", sUrl)})
+		return
+	}
+
+	ld.LongUrl = ld.MovedTo
+	resetCheckState(&ld)
+	ld.UpdatedAt = time.Now()
+
+	ld, err = Store.UpdateLink(sUrl, ld)
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, APIResponse{fmt.Sprintf("The link /%s could not be found", sUrl)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error updating link"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiLink(ld))
+}
+
+// addGeneratedLink stores ld under a shortUrl from ShortCodes, trying again with a new code if it collides
+func addGeneratedLink(ld LinkDoc) (LinkDoc, error) {
+
+	for i := 0; i < maxShortCodeAttempts; i++ {
+
+		code, err := ShortCodes.Generate()
+		if err != nil {
+			return ld, err
+		}
+
+		// A code can come out as one of linkr's own paths or a namespace, so is skipped like one that is taken
+		err = validateShortUrl(code)
+		if err != nil {
+			log.Printf("Generated shortUrl %s can't be used (%s), trying again", code, err)
+			continue
+		}
+		ld.ShortUrl = code
+		if ld.Namespace != "" {
+			ld.ShortUrl = ld.Namespace + "/" + code
+		}
+
+		err = Store.AddLink(ld)
+		if err == ErrDuplicateLink {
+			log.Printf("Generated shortUrl %s is taken, trying again", code)
+			continue
+		}
+
+		return ld, err
+	}
+
+	return ld, ErrShortCodeExhausted
+}
+
+// validateLink checks a link doc is fit to be stored
+func validateLink(ld LinkDoc) error {
+
+	// In a namespace it is the slug after the namespace that has to be valid
+	slug := ld.ShortUrl
+	if ld.Namespace != "" {
+		slug = strings.TrimPrefix(slug, ld.Namespace+"/")
+	}
+
+	err := validatePath(slug)
+	if err != nil {
+		return err
+	}
+
+	return validateLinkSettings(ld)
+}
+
+// validateShortUrl checks a slug is usable
+func validateShortUrl(shortUrl string) error {
+
+	if len(shortUrl) == 0 || len(shortUrl) > maxShortUrlLength {
+		return fmt.Errorf("shortUrl must be between 1 and %v characters", maxShortUrlLength)
+	}
+	if !validShortUrl.MatchString(shortUrl) {
+		return fmt.Errorf("shortUrl may only contain letters, numbers, '-' and '_'")
+	}
+	if reservedShortUrls[strings.ToLower(shortUrl)] || Namespaces[shortUrl] {
+		return fmt.Errorf("shortUrl '%s' is reserved", shortUrl)
+	}
+
+	return nil
+}
+
+// validateLinkSettings checks everything about a link except its shortUrl
+func validateLinkSettings(ld LinkDoc) error {
+
+	err := validateLongUrl(ld.LongUrl)
+	if err != nil {
+		return err
+	}
+
+	if ld.ActiveFrom != nil && ld.ExpiresAt != nil && !ld.ActiveFrom.Before(*ld.ExpiresAt) {
+		return fmt.Errorf("activeFrom must be before expiresAt")
+	}
+	if ld.MaxClicks < 0 {
+		return fmt.Errorf("maxClicks must not be negative")
+	}
+
+	err = validateTargets(ld.Targets)
+	if err != nil {
+		return err
+	}
+
+	err = validateGeoTargets(ld.GeoTargets)
+	if err != nil {
+		return err
+	}
+
+	err = validateLanguages(ld.Languages)
+	if err != nil {
+		return err
+	}
+
+	err = validateVariants(ld.Variants)
+	if err != nil {
+		return err
+	}
+
+	err = validateSchedule(ld.Schedule)
+	if err != nil {
+		return err
+	}
+
+	err = validateStripParams(ld.StripParams)
+	if err != nil {
+		return err
+	}
+
+	if ld.RedirectType != 0 && !validRedirectTypes[ld.RedirectType] {
+		return fmt.Errorf("redirectType must be one of 301, 302, 303, 307 or 308")
+	}
+
+	return nil
+}
+
+// validateLongUrl checks the target of a link is an absolute http(s) url
+func validateLongUrl(longUrl string) error {
+
+	u, err := url.Parse(longUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("longUrl must be an absolute http or https url")
+	}
+
+	return nil
+}
+
+// writeJSON responds with v encoded as JSON and the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, private, max-age=0")
+	w.WriteHeader(status)
+	w.Write(js)
+}
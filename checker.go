@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultCheckWorkers     = 4
+	defaultCheckInterval    = 24 * time.Hour
+	defaultCheckMinInterval = time.Hour
+	defaultCheckPoll        = time.Minute
+	defaultCheckHostLimit   = 2
+	defaultCheckHostDelay   = time.Second
+	defaultCheckMovedAfter  = 3
+
+	// checkBatchSize is the most links fetched from the store per poll
+	checkBatchSize = 500
+
+	// checkUserAgent tells site owners who is checking their pages
+	checkUserAgent = "linkr link checker (+https://github.com/34South/linkr)"
+)
+
+// errTooManyRedirects is returned by the checker's client when a url redirects more than maxRedirects times
+var errTooManyRedirects = fmt.Errorf("More than %v redirects", maxRedirects)
+
+// badURLError is returned when a long url can't be made into a request
+type badURLError struct {
+	error
+}
+
+// LinkChecker rechecks every active link on a schedule, independently of clicks. Each link carries
+// its own nextCheckAt, which is brought forward for popular links and for links that have started
+// failing, and pushed back again as failures continue.
+type LinkChecker struct {
+	Store       LinkStore
+	Workers     int
+	Interval    time.Duration    // how often a link with no clicks and no failures is checked
+	MinInterval time.Duration    // the most often any link is checked
+	Poll        time.Duration    // how often the store is asked for links that are due
+	HostLimit   int              // the most requests to one host at once
+	HostDelay   time.Duration    // the least time between requests to one host
+	MovedAfter  int              // how many checks in a row must permanently redirect to the same url to call a link moved
+	Soft404     *Soft404Detector // finds "not found" pages served as 200 OK, nil to not look
+
+	client   *http.Client
+	hosts    *hostLimiter
+	jobs     chan LinkDoc
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+// NewLinkChecker sets up a checker from LINKR_CHECK_WORKERS, LINKR_CHECK_INTERVAL, LINKR_CHECK_MIN_INTERVAL,
+// LINKR_CHECK_POLL, LINKR_CHECK_HOST_LIMIT, LINKR_CHECK_HOST_DELAY and LINKR_CHECK_MOVED_AFTER. Durations are in
+// Go format, eg "12h" or "90m".
+func NewLinkChecker(store LinkStore) *LinkChecker {
+
+	c := &LinkChecker{
+		Store:       store,
+		Workers:     defaultCheckWorkers,
+		Interval:    envDuration("LINKR_CHECK_INTERVAL", defaultCheckInterval),
+		MinInterval: envDuration("LINKR_CHECK_MIN_INTERVAL", defaultCheckMinInterval),
+		Poll:        envDuration("LINKR_CHECK_POLL", defaultCheckPoll),
+		HostLimit:   defaultCheckHostLimit,
+		HostDelay:   envDuration("LINKR_CHECK_HOST_DELAY", defaultCheckHostDelay),
+		MovedAfter:  defaultCheckMovedAfter,
+		inFlight:    make(map[string]bool),
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINKR_CHECK_WORKERS")); err == nil && n > 0 {
+		c.Workers = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINKR_CHECK_HOST_LIMIT")); err == nil && n > 0 {
+		c.HostLimit = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINKR_CHECK_MOVED_AFTER")); err == nil && n > 0 {
+		c.MovedAfter = n
+	}
+	c.jobs = make(chan LinkDoc, c.Workers)
+	c.hosts = newHostLimiter(c.HostLimit, c.HostDelay)
+
+	// Check link is UP, if it isn't we can record the status. Note that this fancy client
+	// function is here because one link had more than 10 redirects at the remote end.
+	// So this allows us to up the limit (10 is Go default)... it came from here:
+	// https://gist.github.com/VojtechVitek/eb0171fc65f945a8641e
+	// Each redirect followed is also added to the hops the request carries in its context, and waits its turn at
+	// the host it goes to.
+	c.client = &http.Client{
+		Timeout: time.Second * 30,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if hops, ok := req.Context().Value(redirectHopsKey{}).(*[]RedirectHop); ok && req.Response != nil {
+				*hops = append(*hops, RedirectHop{Url: via[len(via)-1].URL.String(), StatusCode: req.Response.StatusCode})
+			}
+			if len(via) > maxRedirects {
+				fmt.Printf("Checking target url had %v redirects\n", len(via))
+				return errTooManyRedirects
+			}
+			time.Sleep(c.hosts.follow(strings.ToLower(req.URL.Hostname()), time.Now()))
+			return nil
+		},
+	}
+
+	return c
+}
+
+// Start fires up the workers and the scheduler, and returns straight away
+func (c *LinkChecker) Start() {
+
+	log.Printf("Starting link checker with %v workers\n", c.Workers)
+
+	for i := 0; i < c.Workers; i++ {
+		go c.work()
+	}
+
+	go func() {
+		for {
+			c.schedule()
+			time.Sleep(c.Poll)
+		}
+	}()
+}
+
+// Enqueue asks for a link to be checked soon, eg the first time it is clicked. It never blocks -
+// if the workers are busy the link will be picked up by the scheduler instead.
+func (c *LinkChecker) Enqueue(ld LinkDoc) {
+
+	if !c.claim(ld.ShortUrl) {
+		return
+	}
+
+	select {
+	case c.jobs <- ld:
+	default:
+		c.release(ld.ShortUrl)
+	}
+}
+
+// schedule hands every link that is due a check to the workers
+func (c *LinkChecker) schedule() {
+
+	links, err := c.Store.DueLinks(time.Now(), checkBatchSize)
+	if err != nil {
+		log.Println("Error finding links to check:", err)
+		return
+	}
+
+	for _, ld := range links {
+		if c.claim(ld.ShortUrl) {
+			c.jobs <- ld
+		}
+	}
+}
+
+func (c *LinkChecker) work() {
+
+	for ld := range c.jobs {
+		c.checkDue(ld)
+		c.release(ld.ShortUrl)
+	}
+}
+
+// checkDue checks a link if it still needs it, and its host can take another request. The link is read again
+// first, as it may have been checked, changed or deleted since it was queued. If the host is busy the link is
+// left due, for a later poll to pick up.
+func (c *LinkChecker) checkDue(ld LinkDoc) {
+
+	ld, err := c.Store.FindLink(ld.ShortUrl)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Println("Error finding link to check:", err)
+		return
+	}
+	now := time.Now()
+	if !ld.Active || ld.NextCheckAt.After(now) {
+		return
+	}
+
+	u, err := url.Parse(ld.LongUrl)
+	if err != nil {
+		c.checkLink(ld, "")
+		return
+	}
+	host := strings.ToLower(u.Hostname())
+
+	wait, ok := c.hosts.reserve(host, now)
+	if !ok {
+		return
+	}
+	defer c.hosts.done(host)
+	time.Sleep(wait)
+
+	c.checkLink(ld, host)
+}
+
+// claim marks a link as being checked, returning false if it already is
+func (c *LinkChecker) claim(shortUrl string) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight[shortUrl] {
+		return false
+	}
+	c.inFlight[shortUrl] = true
+
+	return true
+}
+
+func (c *LinkChecker) release(shortUrl string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inFlight, shortUrl)
+}
+
+// checkLink requests the long url, records the result and schedules the next check
+func (c *LinkChecker) checkLink(ld LinkDoc, host string) {
+
+	fmt.Println("Checking URL ", ld.LongUrl)
+
+	check := LinkCheckDoc{
+		ID:        bson.NewObjectId(),
+		LinkID:    ld.ID,
+		CreatedAt: time.Now(),
+	}
+
+	res, hops, err := c.fetch(ld.LongUrl, host)
+	check.Redirects = hops
+	check.LatencyMs = int64(time.Since(check.CreatedAt) / time.Millisecond)
+	if err != nil {
+		// 'res' is nil so set status here..
+		fmt.Println("Error checking long url:", err)
+
+		// No server response, the class says why
+		check.StatusCode = http.StatusGatewayTimeout
+		check.ErrorClass, check.Error = classifyCheckError(err)
+	} else {
+		res.Body.Close()
+		fmt.Println("HTTP Response: ", res.Status)
+		check.StatusCode = res.StatusCode
+		check.FinalUrl = res.Request.URL.String()
+		if res.StatusCode != http.StatusOK {
+			check.ErrorClass = CheckErrorHTTP
+			check.Error = res.Status
+		}
+	}
+
+	// A 200 may still be a "not found" page
+	if check.StatusCode == http.StatusOK && c.Soft404 != nil {
+		if reason := c.soft404(ld.LongUrl, check.FinalUrl, host); reason != "" {
+			fmt.Println("Soft 404:", reason)
+			check.ErrorClass = CheckErrorSoft404
+			check.Error = reason
+		}
+	}
+
+	failures := 0
+	if check.ErrorClass != "" {
+		failures = ld.CheckFailures + 1
+	}
+
+	if check.StatusCode != ld.LastStatusCode {
+		fmt.Printf("Updating last status code for %s from %v to %v\n", ld.ShortUrl, ld.LastStatusCode, check.StatusCode)
+	}
+
+	// Only flagged as moved once it has happened enough times in a row, as sites sometimes redirect while they
+	// are down for maintenance
+	movedTo := movedURL(ld, check)
+	if movedTo != "" && !c.movedBefore(ld, movedTo) {
+		movedTo = ""
+	}
+	if movedTo != "" && movedTo != ld.MovedTo {
+		fmt.Printf("Link %s has moved from %s to %s\n", ld.ShortUrl, ld.LongUrl, movedTo)
+	}
+
+	next := check.CreatedAt.Add(c.nextInterval(ld.Clicks, failures))
+	err = c.Store.UpdateCheckState(ld.ShortUrl, check, failures, movedTo, next)
+	if err != nil {
+		fmt.Println("Error updating check state:", err)
+	}
+
+	err = c.Store.RecordCheck(check)
+	if err != nil {
+		fmt.Println("Error recording check:", err)
+	}
+}
+
+// movedURL is where a check ended up if it got there only through permanent redirects, and that isn't the
+// link's long url already
+func movedURL(ld LinkDoc, check LinkCheckDoc) string {
+
+	if check.StatusCode != http.StatusOK || check.ErrorClass != "" || len(check.Redirects) == 0 ||
+		check.FinalUrl == ld.LongUrl {
+		return ""
+	}
+	for _, h := range check.Redirects {
+		if h.StatusCode != http.StatusMovedPermanently && h.StatusCode != http.StatusPermanentRedirect {
+			return ""
+		}
+	}
+
+	return check.FinalUrl
+}
+
+// movedBefore reports whether the checks before this one, MovedAfter in all, also moved to u
+func (c *LinkChecker) movedBefore(ld LinkDoc, u string) bool {
+
+	n := c.MovedAfter - 1
+	if n <= 0 {
+		return true
+	}
+
+	lc, err := c.Store.Checks(ld.ID, n)
+	if err != nil {
+		fmt.Println("Error finding previous checks:", err)
+		return false
+	}
+	if len(lc) < n {
+		return false
+	}
+	for _, check := range lc {
+		if movedURL(ld, check) != u {
+			return false
+		}
+	}
+
+	return true
+}
+
+// soft404 says why a link that got a 200 is soft broken, or "" if it isn't. A redirect to the home page is enough,
+// otherwise the start of the final page is fetched and looked at. host is the long url's host, which the caller
+// has reserved. Fetching the page waits its turn like any other request, and is left for next time if the final
+// host is busy.
+func (c *LinkChecker) soft404(longUrl, finalUrl, host string) string {
+
+	if reason := c.Soft404.Redirected(longUrl, finalUrl); reason != "" {
+		return reason
+	}
+
+	req, err := http.NewRequest("GET", finalUrl, nil)
+	if err != nil {
+		return ""
+	}
+
+	var wait time.Duration
+	ok := false
+	finalHost := strings.ToLower(req.URL.Hostname())
+	if finalHost == host {
+		wait, ok = c.hosts.again(host, time.Now())
+	} else if wait, ok = c.hosts.reserve(finalHost, time.Now()); ok {
+		defer c.hosts.done(finalHost)
+	}
+	if !ok {
+		return ""
+	}
+	time.Sleep(wait)
+	req.Header.Set("User-Agent", checkUserAgent)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		fmt.Println("Error fetching page for soft 404 check:", err)
+		return ""
+	}
+	defer res.Body.Close()
+
+	// Only HTML pages have titles and phrases worth looking at, and any other status is for the next check to see
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Type"), "html") {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, soft404MaxBody+1))
+	if err != nil {
+		return ""
+	}
+	complete := len(body) <= soft404MaxBody
+	if !complete {
+		body = body[:soft404MaxBody]
+	}
+
+	return c.Soft404.Page(res.Request.URL.String(), res.Header.Get("Content-Type"), body, complete)
+}
+
+// redirectHopsKey is the context key for the *[]RedirectHop that the client adds each redirect to
+type redirectHopsKey struct{}
+
+// headNotSupported are the statuses from a HEAD request that mean the server doesn't do HEAD, rather than
+// anything about the url
+var headNotSupported = map[int]bool{
+	http.StatusMethodNotAllowed: true,
+	http.StatusNotImplemented:   true,
+}
+
+// fetch requests u with HEAD, as only the status is wanted, falling back to a GET of the first byte if the server
+// doesn't support HEAD. The GET waits its turn at the host like the HEAD did, and hosts found not to support HEAD
+// go straight to the GET next time. The redirects followed on the way to the response, or the error, are returned
+// with it.
+func (c *LinkChecker) fetch(u, host string) (*http.Response, []RedirectHop, error) {
+
+	if !c.hosts.noHead(host) {
+		res, hops, err := c.do("HEAD", u)
+		if err != nil || !headNotSupported[res.StatusCode] {
+			return res, hops, err
+		}
+		res.Body.Close()
+		c.hosts.setNoHead(host)
+		time.Sleep(c.hosts.follow(host, time.Now()))
+	}
+
+	res, hops, err := c.do("GET", u)
+	if err != nil {
+		return res, hops, err
+	}
+
+	// A part of the page, or a range past the end of an empty one, still means the page is there
+	if res.StatusCode == http.StatusPartialContent || res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		res.StatusCode, res.Status = http.StatusOK, "200 OK"
+	}
+
+	return res, hops, nil
+}
+
+func (c *LinkChecker) do(method, u string) (*http.Response, []RedirectHop, error) {
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, nil, badURLError{err}
+	}
+	hops := []RedirectHop{}
+	req = req.WithContext(context.WithValue(req.Context(), redirectHopsKey{}, &hops))
+	req.Header.Set("User-Agent", checkUserAgent)
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+
+	res, err := c.client.Do(req)
+
+	return res, hops, err
+}
+
+// classifyCheckError works out why a check got no response, as one of the CheckError classes, along with a
+// detail message. The detail leaves off the method and url that net/http puts in front of its errors.
+func classifyCheckError(err error) (string, string) {
+
+	detail := err.Error()
+	if ue, ok := err.(*url.Error); ok {
+		detail = ue.Err.Error()
+	}
+
+	timeout := false
+	if ne, ok := err.(net.Error); ok {
+		timeout = ne.Timeout()
+	}
+
+	// Dig down through the errors that net/http and net wrap around the one that says what went wrong
+	cause := err
+	for wrapped := true; wrapped; {
+		switch e := cause.(type) {
+		case *url.Error:
+			cause = e.Err
+		case *net.OpError:
+			cause = e.Err
+		case *os.SyscallError:
+			cause = e.Err
+		default:
+			wrapped = false
+		}
+	}
+
+	switch e := cause.(type) {
+	case badURLError:
+		return CheckErrorURL, detail
+	case *net.DNSError:
+		return CheckErrorDNS, detail
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+		return CheckErrorTLS, detail
+	case syscall.Errno:
+		switch e {
+		case syscall.ECONNREFUSED:
+			return CheckErrorRefused, detail
+		case syscall.ECONNRESET, syscall.EPIPE:
+			return CheckErrorReset, detail
+		}
+	}
+
+	// Newer versions of Go wrap certificate errors in ones of their own, which start "tls: "
+	switch {
+	case cause == errTooManyRedirects:
+		return CheckErrorRedirects, detail
+	case strings.Contains(detail, "tls: "), strings.Contains(detail, "x509: "):
+		return CheckErrorTLS, detail
+	case timeout:
+		return CheckErrorTimeout, detail
+	case cause == io.EOF, cause == io.ErrUnexpectedEOF:
+		return CheckErrorReset, detail
+	case strings.Contains(detail, "unsupported protocol scheme"), strings.Contains(detail, "no Host in request URL"):
+		return CheckErrorURL, detail
+	}
+
+	return CheckErrorNetwork, detail
+}
+
+// nextInterval works out how long until a link is checked again. Popular links are checked more
+// often, as more people are affected when they break. A link that has just started failing is
+// rechecked soon to confirm it, backing off towards the normal interval if it stays broken.
+func (c *LinkChecker) nextInterval(clicks, failures int) time.Duration {
+
+	d := time.Duration(float64(c.Interval) / (1 + math.Log10(1+float64(clicks))))
+
+	if failures > 0 {
+		backoff := c.MinInterval * time.Duration(1<<uint(minInt(failures-1, 16)))
+		if backoff < d {
+			d = backoff
+		}
+	}
+
+	if d < c.MinInterval {
+		d = c.MinInterval
+	}
+
+	// Up to 10% jitter so links added together don't stay bunched up
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+// envDuration reads a duration from the environment, returning def if it is unset or bung
+func envDuration(name string, def time.Duration) time.Duration {
+
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || d <= 0 {
+		return def
+	}
+
+	return d
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+
+	now := time.Now()
+	l := newHostLimiter(2, time.Second)
+	for _, c := range []struct {
+		name string
+		fn   func() (time.Duration, bool)
+		wait time.Duration
+		ok   bool
+	}{
+		{"first", func() (time.Duration, bool) { return l.reserve("a", now) }, 0, true},
+		{"second waits the delay", func() (time.Duration, bool) { return l.reserve("a", now) }, time.Second, true},
+		{"third is over the limit", func() (time.Duration, bool) { return l.reserve("a", now) }, 0, false},
+		{"another host", func() (time.Duration, bool) { return l.reserve("b", now) }, 0, true},
+		{"again at a", func() (time.Duration, bool) { return l.again("a", now) }, 2 * time.Second, true},
+		{"follow at a", func() (time.Duration, bool) { return l.follow("a", now), true }, 3 * time.Second, true},
+		{"follow at a new host", func() (time.Duration, bool) { return l.follow("c", now), true }, 0, true},
+		{"follow at c again", func() (time.Duration, bool) { return l.follow("c", now), true }, time.Second, true},
+	} {
+		wait, ok := c.fn()
+		if wait != c.wait || ok != c.ok {
+			t.Errorf("%s: %v, %v, want %v, %v", c.name, wait, ok, c.wait, c.ok)
+		}
+	}
+
+	// Once one is done there is room for another, after the requests booked so far
+	l.done("a")
+	if wait, ok := l.reserve("a", now); wait != 4*time.Second || !ok {
+		t.Errorf("after done: %v, %v", wait, ok)
+	}
+
+	// Nothing is booked further ahead than maxHostWait, but follow can't be turned down
+	l = newHostLimiter(100, 4*time.Second)
+	for i := 0; i < 3; i++ {
+		l.reserve("a", now)
+	}
+	if _, ok := l.reserve("a", now); ok {
+		t.Error("reserve past maxHostWait")
+	}
+	if _, ok := l.again("a", now); ok {
+		t.Error("again past maxHostWait")
+	}
+	if wait := l.follow("a", now); wait != maxHostWait {
+		t.Errorf("follow past maxHostWait: %v", wait)
+	}
+
+	if l.noHead("a") {
+		t.Error("noHead before setNoHead")
+	}
+	l.setNoHead("a")
+	if !l.noHead("a") || l.noHead("b") {
+		t.Error("noHead wrong after setNoHead")
+	}
+}
+
+// testServer records the method, path and time of every request, and answers with handler
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	times    []time.Time
+}
+
+func newTestServer(handler http.HandlerFunc) *testServer {
+
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		s.times = append(s.times, time.Now())
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+
+	return s
+}
+
+// newTestChecker is a checker with a short host delay, and the host of u, as fetch gets it from checkDue
+func newTestChecker(u string, delay time.Duration) (*LinkChecker, string) {
+
+	c := NewLinkChecker(NewMemoryStore())
+	c.hosts = newHostLimiter(c.HostLimit, delay)
+	host := strings.Split(strings.TrimPrefix(u, "http://"), ":")[0]
+
+	return c, host
+}
+
+func TestFetchHeadFallback(t *testing.T) {
+
+	s := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Range") != "bytes=0-0" {
+			t.Errorf("GET without a range: %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Range", "bytes 0-0/10")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("x"))
+	})
+	defer s.Close()
+
+	delay := 100 * time.Millisecond
+	c, host := newTestChecker(s.URL, delay)
+	start := time.Now()
+	c.hosts.reserve(host, start)
+	res, _, err := c.fetch(s.URL+"/page", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status %v, want 200", res.StatusCode)
+	}
+	if strings.Join(s.requests, ", ") != "HEAD /page, GET /page" {
+		t.Errorf("requests %v", s.requests)
+	}
+	if gap := s.times[1].Sub(start); gap < delay {
+		t.Errorf("GET %v after the HEAD was booked, want at least %v", gap, delay)
+	}
+
+	// The host is remembered as not doing HEAD
+	res, _, err = c.fetch(s.URL+"/other", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s.requests[len(s.requests)-1] != "GET /other" || len(s.requests) != 3 {
+		t.Errorf("requests %v", s.requests)
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+
+	s := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		case "/c":
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	defer s.Close()
+
+	delay := 100 * time.Millisecond
+	c, host := newTestChecker(s.URL, delay)
+	start := time.Now()
+	c.hosts.reserve(host, start)
+	res, hops, err := c.fetch(s.URL+"/a", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	want := []RedirectHop{{s.URL + "/a", http.StatusMovedPermanently}, {s.URL + "/b", http.StatusFound}}
+	if len(hops) != 2 || hops[0] != want[0] || hops[1] != want[1] {
+		t.Errorf("hops %v, want %v", hops, want)
+	}
+	if res.Request.URL.Path != "/c" {
+		t.Errorf("ended up at %s", res.Request.URL)
+	}
+
+	// Each hop waits its turn at the host
+	for i, at := range s.times {
+		if gap := at.Sub(start); gap < time.Duration(i)*delay {
+			t.Errorf("%s %v after the first was booked, want at least %v", s.requests[i], gap, time.Duration(i)*delay)
+		}
+	}
+}
+
+func TestNextInterval(t *testing.T) {
+
+	c := &LinkChecker{Interval: 24 * time.Hour, MinInterval: time.Hour}
+	for _, x := range []struct {
+		clicks, failures int
+		want             time.Duration
+	}{
+		{0, 0, 24 * time.Hour},
+		{9, 0, 12 * time.Hour},
+		{99, 0, 8 * time.Hour},
+		{1e9, 0, 24 * time.Hour / 10},
+		{0, 1, time.Hour},
+		{0, 2, 2 * time.Hour},
+		{0, 4, 8 * time.Hour},
+		{0, 6, 24 * time.Hour},
+		{0, 100, 24 * time.Hour},
+		{99, 5, 8 * time.Hour},
+	} {
+		// Up to 10% is added at random
+		for i := 0; i < 20; i++ {
+			got := c.nextInterval(x.clicks, x.failures)
+			if got < x.want || got > x.want+x.want/10 {
+				t.Errorf("%d clicks, %d failures: %v, want %v to %v", x.clicks, x.failures, got, x.want, x.want+x.want/10)
+				break
+			}
+		}
+	}
+
+	// Never sooner than MinInterval
+	c.MinInterval = 6 * time.Hour
+	if got := c.nextInterval(1e9, 0); got < c.MinInterval {
+		t.Errorf("busy link in %v, want at least %v", got, c.MinInterval)
+	}
+}
+
+func TestCheckDue(t *testing.T) {
+
+	status := http.StatusOK
+	s := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	defer s.Close()
+
+	store := NewMemoryStore()
+	c, _ := newTestChecker(s.URL, 0)
+	c.Store = store
+	for _, ld := range []LinkDoc{
+		{ShortUrl: "due", LongUrl: s.URL + "/due", Active: true},
+		{ShortUrl: "later", LongUrl: s.URL + "/later", Active: true, NextCheckAt: time.Now().Add(time.Hour)},
+		{ShortUrl: "off", LongUrl: s.URL + "/off"},
+	} {
+		store.AddLink(ld)
+	}
+
+	// Only a link that is active and due is checked, and is then due again in about Interval
+	for _, shortUrl := range []string{"due", "later", "off", "gone"} {
+		c.checkDue(LinkDoc{ShortUrl: shortUrl})
+	}
+	if strings.Join(s.requests, ", ") != "HEAD /due" {
+		t.Errorf("requests %v", s.requests)
+	}
+	ld, _ := store.FindLink("due")
+	if ld.LastStatusCode != http.StatusOK || ld.CheckFailures != 0 || ld.NextCheckAt.Before(time.Now().Add(c.Interval)) {
+		t.Errorf("after a good check %+v", ld)
+	}
+	if checks, _ := store.Checks(ld.ID, 0); len(checks) != 1 {
+		t.Errorf("%v checks recorded, want 1", len(checks))
+	}
+
+	// A failure is counted, and rechecked sooner
+	status = http.StatusInternalServerError
+	c.checkLink(ld, "")
+	ld, _ = store.FindLink("due")
+	if ld.LastStatusCode != status || ld.LastErrorClass != CheckErrorHTTP || ld.CheckFailures != 1 ||
+		ld.NextCheckAt.After(time.Now().Add(c.MinInterval+c.MinInterval/10)) {
+		t.Errorf("after a failed check %+v", ld)
+	}
+	c.checkLink(ld, "")
+	if ld, _ = store.FindLink("due"); ld.CheckFailures != 2 {
+		t.Errorf("failures %v after two, want 2", ld.CheckFailures)
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyCheckError(t *testing.T) {
+
+	// wrap dresses err up the way net/http hands it back
+	wrap := func(err error) error {
+		return &url.Error{Op: "Head", URL: "https://example.org/", Err: err}
+	}
+	dial := func(errno syscall.Errno) error {
+		return wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)})
+	}
+
+	for _, c := range []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"bad url", badURLError{errors.New(`parse "%zz": invalid URL escape`)}, CheckErrorURL},
+		{"dns", wrap(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nope.example"}}), CheckErrorDNS},
+		{"refused", dial(syscall.ECONNREFUSED), CheckErrorRefused},
+		{"reset", dial(syscall.ECONNRESET), CheckErrorReset},
+		{"broken pipe", dial(syscall.EPIPE), CheckErrorReset},
+		{"other errno", dial(syscall.EHOSTUNREACH), CheckErrorNetwork},
+		{"redirects", wrap(errTooManyRedirects), CheckErrorRedirects},
+		{"certificate", wrap(x509.UnknownAuthorityError{}), CheckErrorTLS},
+		{"wrapped certificate", wrap(errors.New("tls: failed to verify certificate: x509: certificate has expired")), CheckErrorTLS},
+		{"timeout", wrap(timeoutError{}), CheckErrorTimeout},
+		{"eof", wrap(io.EOF), CheckErrorReset},
+		{"unexpected eof", wrap(io.ErrUnexpectedEOF), CheckErrorReset},
+		{"scheme", wrap(errors.New(`unsupported protocol scheme "ftp"`)), CheckErrorURL},
+		{"no host", wrap(errors.New("http: no Host in request URL")), CheckErrorURL},
+		{"anything else", errors.New("something broke"), CheckErrorNetwork},
+	} {
+		if class, _ := classifyCheckError(c.err); class != c.class {
+			t.Errorf("%s: %s, want %s", c.name, class, c.class)
+		}
+	}
+
+	// The detail leaves out the method and url, which are known already
+	if _, detail := classifyCheckError(wrap(io.EOF)); detail != "EOF" {
+		t.Errorf("detail %q, want EOF", detail)
+	}
+
+	// And from a real request to a port nothing is listening on
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	c, host := newTestChecker(s.URL, 0)
+	c.hosts.reserve(host, time.Now())
+	if _, _, err := c.fetch(s.URL+"/", host); err == nil {
+		t.Error("closed server: no error")
+	} else if class, detail := classifyCheckError(err); class != CheckErrorRefused {
+		t.Errorf("closed server: %s, %s", class, detail)
+	}
+}
+
+func TestMovedURL(t *testing.T) {
+
+	ld := LinkDoc{LongUrl: "https://example.org/old"}
+	moved := []RedirectHop{{"https://example.org/old", http.StatusMovedPermanently}}
+	for _, c := range []struct {
+		name  string
+		check LinkCheckDoc
+		want  string
+	}{
+		{"301", LinkCheckDoc{StatusCode: 200, FinalUrl: "https://example.org/new", Redirects: moved}, "https://example.org/new"},
+		{"301 then 308", LinkCheckDoc{StatusCode: 200, FinalUrl: "https://example.org/new", Redirects: []RedirectHop{
+			{"https://example.org/old", http.StatusMovedPermanently},
+			{"https://example.org/mid", http.StatusPermanentRedirect}}}, "https://example.org/new"},
+		{"301 then 302", LinkCheckDoc{StatusCode: 200, FinalUrl: "https://example.org/new", Redirects: []RedirectHop{
+			{"https://example.org/old", http.StatusMovedPermanently},
+			{"https://example.org/mid", http.StatusFound}}}, ""},
+		{"no redirects", LinkCheckDoc{StatusCode: 200, FinalUrl: "https://example.org/old"}, ""},
+		{"back where it started", LinkCheckDoc{StatusCode: 200, FinalUrl: "https://example.org/old", Redirects: moved}, ""},
+		{"not found there", LinkCheckDoc{StatusCode: 404, FinalUrl: "https://example.org/new", Redirects: moved}, ""},
+		{"soft 404 there", LinkCheckDoc{StatusCode: 200, FinalUrl: "https://example.org/", Redirects: moved,
+			ErrorClass: CheckErrorSoft404}, ""},
+	} {
+		if got := movedURL(ld, c.check); got != c.want {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCheckMoved(t *testing.T) {
+
+	s := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		}
+	})
+	defer s.Close()
+
+	store := NewMemoryStore()
+	c, _ := newTestChecker(s.URL, 0)
+	c.Store = store
+	store.AddLink(LinkDoc{ShortUrl: "moving", LongUrl: s.URL + "/old", Active: true})
+
+	// Only moved once MovedAfter checks in a row have said so
+	for i := 1; i <= c.MovedAfter; i++ {
+		ld, _ := store.FindLink("moving")
+		c.checkLink(ld, "")
+		ld, _ = store.FindLink("moving")
+		if moved := ld.MovedTo != ""; moved != (i == c.MovedAfter) {
+			t.Errorf("after %v checks moved to %q", i, ld.MovedTo)
+		}
+	}
+	if ld, _ := store.FindLink("moving"); ld.MovedTo != s.URL+"/new" || ld.CheckFailures != 0 {
+		t.Errorf("moved to %q with %v failures", ld.MovedTo, ld.CheckFailures)
+	}
+}
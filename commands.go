@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// commands are run as `linkr <command> [flags]` instead of starting the server. They get the arguments after
+// the command name and return the exit code.
+var commands = map[string]func(args []string) int{
+	"import": importCommand,
+	"export": exportCommand,
+}
+
+// runCommand runs the named command, once the store and the rest of the config are set up
+func runCommand(name string, args []string) int {
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", name)
+		fmt.Fprintln(os.Stderr, "usage: linkr [import|export] [flags]")
+		return 2
+	}
+
+	return cmd(args)
+}
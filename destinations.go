@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	variantCookiePrefix = "linkr_ab_"
+	variantCookieAge    = 30 * 24 * time.Hour
+)
+
+// TargetRule sends visitors whose User-Agent matches every criterion that is set to Url
+type TargetRule struct {
+	ID      string `json:"id,omitempty" bson:"id,omitempty"`
+	OS      string `json:"os,omitempty" bson:"os,omitempty"`
+	Device  string `json:"device,omitempty" bson:"device,omitempty"`
+	Browser string `json:"browser,omitempty" bson:"browser,omitempty"`
+	Url     string `json:"url" bson:"url"`
+}
+
+// Matches reports whether ua meets the rule, comparing families case insensitively
+func (t TargetRule) Matches(ua UserAgent) bool {
+
+	if t.OS != "" && !strings.EqualFold(t.OS, ua.OS) {
+		return false
+	}
+	if t.Device != "" && !strings.EqualFold(t.Device, ua.Device) {
+		return false
+	}
+	if t.Browser != "" && !strings.EqualFold(t.Browser, ua.Browser) {
+		return false
+	}
+
+	return true
+}
+
+// variant names the rule in click stats, its ID if it has one, otherwise its position
+func (t TargetRule) variant(i int) string {
+
+	if t.ID != "" {
+		return t.ID
+	}
+
+	return "target-" + strconv.Itoa(i+1)
+}
+
+// GeoRule sends visitors from any of Countries, ISO 3166 codes such as AU, to Url
+type GeoRule struct {
+	ID        string   `json:"id,omitempty" bson:"id,omitempty"`
+	Countries []string `json:"countries" bson:"countries"`
+	Url       string   `json:"url" bson:"url"`
+}
+
+// Matches reports whether country is one of the rule's countries
+func (g GeoRule) Matches(country string) bool {
+
+	for _, c := range g.Countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// variant names the rule in click stats, its ID if it has one, otherwise its position
+func (g GeoRule) variant(i int) string {
+
+	if g.ID != "" {
+		return g.ID
+	}
+
+	return "geo-" + strconv.Itoa(i+1)
+}
+
+// Variant is one of the destinations of an A/B split, chosen in proportion to its Weight
+type Variant struct {
+	ID     string `json:"id" bson:"id"`
+	Url    string `json:"url" bson:"url"`
+	Weight int    `json:"weight" bson:"weight"`
+}
+
+// destination works out where the visitor should be sent, and the variant to record with the click.
+// The longUrl, the fallback, is variant "". It may set a cookie so must be called before anything is written.
+func destination(w http.ResponseWriter, r *http.Request, ld LinkDoc) (string, string) {
+
+	// A schedule entry for right now takes over from everything else
+	if i := activeSchedule(ld, time.Now()); i >= 0 {
+		return ld.Schedule[i].Url, ld.Schedule[i].variant(i)
+	}
+
+	// Device targeting rules, in order, first match wins
+	if len(ld.Targets) > 0 {
+		ua := ParseUserAgent(r.UserAgent())
+		for i, t := range ld.Targets {
+			if t.Matches(ua) {
+				return t.Url, t.variant(i)
+			}
+		}
+	}
+
+	// Regional destinations, by the country of the visitor's IP
+	if len(ld.GeoTargets) > 0 {
+		if country := GeoIP.Country(clientIP(r)); country != "" {
+			for i, g := range ld.GeoTargets {
+				if g.Matches(country) {
+					return g.Url, g.variant(i)
+				}
+			}
+		}
+	}
+
+	// The visitor's language, or ?lang= to try out a particular one
+	if len(ld.Languages) > 0 {
+		accept := r.URL.Query().Get("lang")
+		if accept == "" {
+			accept = r.Header.Get("Accept-Language")
+		}
+		available := make([]string, 0, len(ld.Languages))
+		for tag := range ld.Languages {
+			available = append(available, tag)
+		}
+		if tag := matchLanguage(accept, available); tag != "" {
+			return ld.Languages[tag], "lang-" + tag
+		}
+	}
+
+	// A/B split, sticking with whatever the visitor got last time
+	if len(ld.Variants) > 0 {
+		v := stickyVariant(r, ld)
+		if v == nil {
+			v = pickVariant(ld.Variants)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName(variantCookiePrefix, ld.ShortUrl),
+			Value:    v.ID,
+			Path:     "/" + ld.ShortUrl,
+			Expires:  time.Now().Add(variantCookieAge),
+			HttpOnly: true,
+		})
+		return v.Url, v.ID
+	}
+
+	return ld.LongUrl, ""
+}
+
+// stickyVariant returns the variant named in the visitor's cookie, if it is still one of the link's variants
+func stickyVariant(r *http.Request, ld LinkDoc) *Variant {
+
+	c, err := r.Cookie(cookieName(variantCookiePrefix, ld.ShortUrl))
+	if err != nil {
+		return nil
+	}
+
+	for i := range ld.Variants {
+		if ld.Variants[i].ID == c.Value {
+			return &ld.Variants[i]
+		}
+	}
+
+	return nil
+}
+
+// pickVariant chooses a variant at random, weighted. Variants must have been validated so the total is positive.
+func pickVariant(vs []Variant) *Variant {
+
+	total := 0
+	for _, v := range vs {
+		total += v.Weight
+	}
+
+	n := rand.Intn(total)
+	for i := range vs {
+		n -= vs[i].Weight
+		if n < 0 {
+			return &vs[i]
+		}
+	}
+
+	return &vs[len(vs)-1]
+}
+
+// validateVariants checks each variant has a unique id, a usable url and a positive weight
+func validateVariants(vs []Variant) error {
+
+	ids := make(map[string]bool)
+	for i, v := range vs {
+		if v.ID == "" || !validShortUrl.MatchString(v.ID) {
+			return fmt.Errorf("variants[%d] id may only contain letters, numbers, '-' and '_'", i)
+		}
+		if ids[v.ID] {
+			return fmt.Errorf("variants[%d] id '%s' is used more than once", i, v.ID)
+		}
+		ids[v.ID] = true
+		if v.Weight <= 0 {
+			return fmt.Errorf("variants[%d] weight must be more than 0", i)
+		}
+		err := validateLongUrl(v.Url)
+		if err != nil {
+			return fmt.Errorf("variants[%d] url: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateGeoTargets checks each rule has a usable url and valid country codes
+func validateGeoTargets(gs []GeoRule) error {
+
+	for i, g := range gs {
+		if len(g.Countries) == 0 {
+			return fmt.Errorf("geoTargets[%d] needs at least one country", i)
+		}
+		for _, c := range g.Countries {
+			if !validCountry.MatchString(c) {
+				return fmt.Errorf("geoTargets[%d] country '%s' should be a two letter ISO 3166 code, eg AU", i, c)
+			}
+		}
+		err := validateLongUrl(g.Url)
+		if err != nil {
+			return fmt.Errorf("geoTargets[%d] url: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateTargets checks each rule has a usable url and at least one thing to match on
+func validateTargets(ts []TargetRule) error {
+
+	for i, t := range ts {
+		if t.OS == "" && t.Device == "" && t.Browser == "" {
+			return fmt.Errorf("targets[%d] needs at least one of os, device or browser", i)
+		}
+		if t.Device != "" && !validDevices[strings.ToLower(t.Device)] {
+			return fmt.Errorf("targets[%d] device must be one of desktop, mobile, tablet or bot", i)
+		}
+		err := validateLongUrl(t.Url)
+		if err != nil {
+			return fmt.Errorf("targets[%d] url: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+var validCountry = regexp.MustCompile(`^[A-Za-z]{2}$`)
+
+var validDevices = map[string]bool{
+	DeviceDesktop: true,
+	DeviceMobile:  true,
+	DeviceTablet:  true,
+	DeviceBot:     true,
+}
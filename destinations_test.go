@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPickVariant(t *testing.T) {
+
+	vs := []Variant{{ID: "a", Weight: 1}, {ID: "b", Weight: 3}, {ID: "c", Weight: 6}}
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[pickVariant(vs).ID]++
+	}
+
+	// Each gets its share, give or take
+	for _, v := range vs {
+		want := 1000 * v.Weight
+		if n := counts[v.ID]; n < want*8/10 || n > want*12/10 {
+			t.Errorf("%s picked %v times in 10000, want about %v", v.ID, n, want)
+		}
+	}
+
+	// The one returned is the link's own, not a copy
+	if v := pickVariant(vs[:1]); v != &vs[0] {
+		t.Errorf("picked %p, want %p", v, &vs[0])
+	}
+}
+
+func TestStickyVariant(t *testing.T) {
+
+	ld := LinkDoc{ShortUrl: "ab", Variants: []Variant{{ID: "a", Weight: 1}, {ID: "b", Weight: 1}}}
+	for _, c := range []struct {
+		name, cookie, value, want string
+	}{
+		{"this link's cookie", cookieName(variantCookiePrefix, "ab"), "b", "b"},
+		{"a variant that has gone", cookieName(variantCookiePrefix, "ab"), "c", ""},
+		{"another link's cookie", cookieName(variantCookiePrefix, "ab/c"), "a", ""},
+		{"no cookie", "", "", ""},
+	} {
+		r := httptest.NewRequest("GET", "/ab", nil)
+		if c.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: c.cookie, Value: c.value})
+		}
+		got := ""
+		if v := stickyVariant(r, ld); v != nil {
+			got = v.ID
+		}
+		if got != c.want {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestVariantCookie(t *testing.T) {
+
+	ld := LinkDoc{ShortUrl: "ab", LongUrl: "https://example.org/", Variants: []Variant{
+		{ID: "a", Url: "https://example.org/a", Weight: 1},
+		{ID: "b", Url: "https://example.org/b", Weight: 1},
+	}}
+
+	// The variant picked is remembered for the link's path
+	w := httptest.NewRecorder()
+	url, variant := destination(w, httptest.NewRequest("GET", "/ab", nil), ld)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieName(variantCookiePrefix, "ab") || cookies[0].Value != variant ||
+		cookies[0].Path != "/ab" || !cookies[0].HttpOnly {
+		t.Fatalf("cookies %+v for variant %q", cookies, variant)
+	}
+	if url != "https://example.org/"+variant {
+		t.Errorf("variant %q went to %s", variant, url)
+	}
+
+	// And kept every time after
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest("GET", "/ab", nil)
+		r.AddCookie(cookies[0])
+		if _, v := destination(httptest.NewRecorder(), r, ld); v != variant {
+			t.Fatalf("visit %v got %q, want %q", i+2, v, variant)
+		}
+	}
+}
+
+func TestValidateVariants(t *testing.T) {
+
+	for _, c := range []struct {
+		name string
+		vs   []Variant
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"two", []Variant{{"a", "https://example.org/a", 1}, {"b", "https://example.org/b", 2}}, true},
+		{"no id", []Variant{{"", "https://example.org/a", 1}}, false},
+		{"bad id", []Variant{{"a b", "https://example.org/a", 1}}, false},
+		{"same id", []Variant{{"a", "https://example.org/a", 1}, {"a", "https://example.org/b", 1}}, false},
+		{"no weight", []Variant{{"a", "https://example.org/a", 0}}, false},
+		{"bad url", []Variant{{"a", "example", 1}}, false},
+	} {
+		if err := validateVariants(c.vs); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
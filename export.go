@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The files written alongside the index.html pages by an export
+const (
+	exportState     = ".linkr-export.json"
+	exportRedirects = "_redirects"
+	exportNginx     = "nginx-map.conf"
+	exportApache    = "apache-redirects.conf"
+)
+
+// exportPage is the page for each link, for static hosts that only serve files
+var exportPage = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ if .Title }}{{ .Title }}{{ else }}Redirecting...{{ end }}</title>
+<link rel="canonical" href="{{ .LongUrl }}">
+<meta name="robots" content="noindex">
+<meta http-equiv="refresh" content="0; url={{ .LongUrl }}">
+</head>
+<body>
+<p>Redirecting to <a href="{{ .LongUrl }}">{{ .LongUrl }}</a></p>
+</body>
+</html>
+`))
+
+// exportCommand writes the links out as a static site that any host can serve: an index.html for each link that
+// redirects with a meta refresh, plus a Netlify _redirects file, an nginx map and Apache RedirectMatch lines.
+// Pages are only rewritten for links updated since the last export, unless -full is given.
+func exportCommand(args []string) int {
+
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := fs.String("dir", "./public", "directory to write the site to")
+	full := fs.Bool("full", false, "rewrite every page, not just those for links changed since the last export")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: linkr export [-dir dir] [-full]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	links, err := Store.Links()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding links:", err)
+		return 1
+	}
+
+	err = os.MkdirAll(*dir, 0755)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// The UpdatedAt of each link when its page was last written. It is read even for -full, which rewrites every
+	// page, so that pages for links that have gone since are still removed.
+	state := make(map[string]time.Time)
+	b, err := ioutil.ReadFile(filepath.Join(*dir, exportState))
+	if err == nil {
+		err = json.Unmarshal(b, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", exportState, err)
+		return 1
+	}
+
+	now := time.Now()
+	exported := make(map[string]time.Time)
+	var written, unchanged, skipped, removed int
+	var included []LinkDoc
+	for _, ld := range links {
+		if reason := exportSkipReason(ld, now); reason != "" {
+			fmt.Printf("- /%s: %s\n", ld.ShortUrl, reason)
+			skipped++
+			continue
+		}
+		included = append(included, ld)
+		exported[ld.ShortUrl] = ld.UpdatedAt
+
+		page := filepath.Join(*dir, filepath.FromSlash(ld.ShortUrl), "index.html")
+		if t, ok := state[ld.ShortUrl]; ok && t.Equal(ld.UpdatedAt) && !*full {
+			if _, err := os.Stat(page); err == nil {
+				unchanged++
+				continue
+			}
+		}
+
+		var b bytes.Buffer
+		err = exportPage.Execute(&b, ld)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(page), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(page, b.Bytes(), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "/%s: %s\n", ld.ShortUrl, err)
+			return 1
+		}
+		written++
+	}
+
+	// Pages for links that have gone, or can no longer be exported
+	for shortUrl := range state {
+		if _, ok := exported[shortUrl]; ok {
+			continue
+		}
+		page := filepath.Join(*dir, filepath.FromSlash(shortUrl), "index.html")
+		err = os.Remove(page)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "/%s: %s\n", shortUrl, err)
+			return 1
+		}
+		// Only goes if nothing else, such as a page under a prefix link, is in there
+		os.Remove(filepath.Dir(page))
+		removed++
+	}
+
+	// The redirect files are quick to make so are always rewritten, but only touched if they change
+	for name, content := range map[string]string{
+		exportRedirects: exportRedirectsFile(included),
+		exportNginx:     exportNginxMap(included),
+		exportApache:    exportApacheFile(included),
+	} {
+		err = writeIfChanged(filepath.Join(*dir, name), []byte(content))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	b, err = json.MarshalIndent(exported, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(*dir, exportState), b, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("%d pages written, %d unchanged, %d removed, %d links not exported\n", written, unchanged, removed, skipped)
+
+	return 0
+}
+
+// exportSkipReason says why a link can't go in a static export, or is "" if it can. A static site can't ask for
+// a password or count clicks, so protected links and those that aren't live now are left out.
+func exportSkipReason(ld LinkDoc, t time.Time) string {
+
+	switch {
+	case !ld.Active:
+		return "inactive"
+	case ld.PasswordHash != "":
+		return "password protected"
+	case linkAvailability(ld, t) != linkAvailable:
+		return "not available now"
+	case strings.Split(ld.ShortUrl, "/")[0] == exportRedirects:
+		return "clashes with the _redirects file"
+	}
+
+	return ""
+}
+
+// exportOrder puts exact links before prefix links, and longer prefixes before shorter ones, as nginx regexes,
+// Apache and Netlify all use the first match
+func exportOrder(links []LinkDoc) []LinkDoc {
+
+	r := append([]LinkDoc(nil), links...)
+	sort.SliceStable(r, func(i, j int) bool {
+		if r[i].Prefix != r[j].Prefix {
+			return !r[i].Prefix
+		}
+		if r[i].Prefix && len(r[i].ShortUrl) != len(r[j].ShortUrl) {
+			return len(r[i].ShortUrl) > len(r[j].ShortUrl)
+		}
+		return r[i].ShortUrl < r[j].ShortUrl
+	})
+
+	return r
+}
+
+// exportURL makes a url safe to put in a config file without quoting
+var exportURL = strings.NewReplacer(" ", "%20", `"`, "%22", "'", "%27", ";", "%3B")
+
+// exportRedirectsFile is the links as a Netlify _redirects file. The status is forced with ! so that the
+// redirect wins over the index.html page at the same path.
+func exportRedirectsFile(links []LinkDoc) string {
+
+	var b bytes.Buffer
+	b.WriteString("# Exported by linkr\n")
+	for _, ld := range exportOrder(links) {
+		to := exportURL.Replace(ld.LongUrl)
+		fmt.Fprintf(&b, "/%s %s %d!\n", ld.ShortUrl, to, redirectType(ld))
+		if ld.Prefix {
+			fmt.Fprintf(&b, "/%s/* %s/:splat %d!\n", ld.ShortUrl, strings.TrimSuffix(to, "/"), redirectType(ld))
+		}
+	}
+
+	return b.String()
+}
+
+// exportNginxMap is the links as nginx maps from the request path to the url, one map for each status as
+// return can't take the status from a variable
+func exportNginxMap(links []LinkDoc) string {
+
+	byStatus := make(map[int][]LinkDoc)
+	var statuses []int
+	for _, ld := range exportOrder(links) {
+		s := redirectType(ld)
+		if byStatus[s] == nil {
+			statuses = append(statuses, s)
+		}
+		byStatus[s] = append(byStatus[s], ld)
+	}
+	sort.Ints(statuses)
+
+	var b bytes.Buffer
+	b.WriteString("# Exported by linkr. Include this in the http block, and in the server block add:\n")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "#     if ($linkr_%d) { return %d $linkr_%d; }\n", s, s, s)
+	}
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "\nmap $uri $linkr_%d {\n", s)
+		for _, ld := range byStatus[s] {
+			to := exportURL.Replace(ld.LongUrl)
+			if ld.Prefix {
+				fmt.Fprintf(&b, "    \"~^/%s(/.*)?$\" \"%s$1\";\n", regexp.QuoteMeta(ld.ShortUrl), strings.TrimSuffix(to, "/"))
+			} else {
+				fmt.Fprintf(&b, "    \"/%s\" \"%s\";\n", ld.ShortUrl, to)
+			}
+		}
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+// exportApacheFile is the links as Apache RedirectMatch lines, for the server config or .htaccess
+func exportApacheFile(links []LinkDoc) string {
+
+	var b bytes.Buffer
+	b.WriteString("# Exported by linkr\n")
+	for _, ld := range exportOrder(links) {
+		to := exportURL.Replace(ld.LongUrl)
+		if ld.Prefix {
+			fmt.Fprintf(&b, "RedirectMatch %d ^/%s(/.*)?$ %s$1\n", redirectType(ld), regexp.QuoteMeta(ld.ShortUrl), strings.TrimSuffix(to, "/"))
+		} else {
+			fmt.Fprintf(&b, "RedirectMatch %d ^/%s/?$ %s\n", redirectType(ld), regexp.QuoteMeta(ld.ShortUrl), to)
+		}
+	}
+
+	return b.String()
+}
+
+// writeIfChanged writes b to the named file unless it already holds exactly that, so file times only move on
+// when something changed
+func writeIfChanged(name string, b []byte) error {
+
+	old, err := ioutil.ReadFile(name)
+	if err == nil && bytes.Equal(old, b) {
+		return nil
+	}
+
+	return ioutil.WriteFile(name, b, 0644)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// addTestLinks adds active links to the Store
+func addTestLinks(t *testing.T, links ...LinkDoc) {
+
+	for _, ld := range links {
+		ld.ID = bson.NewObjectId()
+		ld.Active = !strings.HasPrefix(ld.ShortUrl, "off")
+		if ld.UpdatedAt.IsZero() {
+			ld.UpdatedAt = time.Now()
+		}
+		err := Store.AddLink(ld)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+	return err == nil
+}
+
+func TestExport(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "linkr-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Store = NewMemoryStore()
+	addTestLinks(t,
+		LinkDoc{ShortUrl: "a", LongUrl: "https://example.org/a", Title: "A"},
+		LinkDoc{ShortUrl: "b", LongUrl: "https://example.org/b"},
+		LinkDoc{ShortUrl: "docs", LongUrl: "https://example.org/documentation/", Prefix: true, RedirectType: 308},
+		LinkDoc{ShortUrl: "pw", LongUrl: "https://example.org/pw", PasswordHash: "x"},
+		LinkDoc{ShortUrl: "off", LongUrl: "https://example.org/off"},
+	)
+
+	if code := exportCommand([]string{"-dir", dir}); code != 0 {
+		t.Fatalf("export: %d", code)
+	}
+	for name, want := range map[string]bool{
+		"a/index.html":    true,
+		"b/index.html":    true,
+		"docs/index.html": true,
+		"pw/index.html":   false,
+		"off/index.html":  false,
+	} {
+		if exists(dir, name) != want {
+			t.Errorf("%s exists is %v, want %v", name, !want, want)
+		}
+	}
+
+	page, _ := ioutil.ReadFile(filepath.Join(dir, "a", "index.html"))
+	if !strings.Contains(string(page), `<meta http-equiv="refresh" content="0; url=https://example.org/a">`) {
+		t.Errorf("a/index.html is\n%s", page)
+	}
+
+	redirects, _ := ioutil.ReadFile(filepath.Join(dir, exportRedirects))
+	want := "# Exported by linkr\n" +
+		"/a https://example.org/a 303!\n" +
+		"/b https://example.org/b 303!\n" +
+		"/docs https://example.org/documentation/ 308!\n" +
+		"/docs/* https://example.org/documentation/:splat 308!\n"
+	if string(redirects) != want {
+		t.Errorf("_redirects is\n%s\nwant\n%s", redirects, want)
+	}
+
+	// An incremental export leaves pages for unchanged links alone, -full rewrites them
+	err = ioutil.WriteFile(filepath.Join(dir, "a", "index.html"), []byte("edited"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportCommand([]string{"-dir", dir})
+	if page, _ = ioutil.ReadFile(filepath.Join(dir, "a", "index.html")); string(page) != "edited" {
+		t.Error("unchanged page was rewritten")
+	}
+	exportCommand([]string{"-dir", dir, "-full"})
+	if page, _ = ioutil.ReadFile(filepath.Join(dir, "a", "index.html")); string(page) == "edited" {
+		t.Error("-full didn't rewrite the page")
+	}
+
+	// A link deleted before a -full export still has its page removed, and isn't forgotten by the next export
+	Store.DeleteLink("b")
+	exportCommand([]string{"-dir", dir, "-full"})
+	if exists(dir, "b/index.html") || exists(dir, "b") {
+		t.Error("-full left the page for a deleted link")
+	}
+	exportCommand([]string{"-dir", dir})
+	if exists(dir, "b/index.html") || !exists(dir, "a/index.html") {
+		t.Error("pages wrong after the next export")
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+
+	links := []LinkDoc{
+		{ShortUrl: "docs", LongUrl: "https://example.org/d/", Prefix: true, RedirectType: 301},
+		{ShortUrl: "x", LongUrl: "https://example.org/x y", RedirectType: 302},
+		{ShortUrl: "docs/api", LongUrl: "https://api.example.org", Prefix: true, RedirectType: 301},
+		{ShortUrl: "old/page.html", LongUrl: "https://example.org/new", RedirectType: 301},
+	}
+
+	nginx := exportNginxMap(links)
+	for _, line := range []string{
+		"#     if ($linkr_301) { return 301 $linkr_301; }\n",
+		"map $uri $linkr_301 {\n" +
+			"    \"/old/page.html\" \"https://example.org/new\";\n" +
+			"    \"~^/docs/api(/.*)?$\" \"https://api.example.org$1\";\n" +
+			"    \"~^/docs(/.*)?$\" \"https://example.org/d$1\";\n}\n",
+		"map $uri $linkr_302 {\n    \"/x\" \"https://example.org/x%20y\";\n}\n",
+	} {
+		if !strings.Contains(nginx, line) {
+			t.Errorf("nginx map is missing\n%s\nin\n%s", line, nginx)
+		}
+	}
+
+	apache := exportApacheFile(links)
+	want := "# Exported by linkr\n" +
+		"RedirectMatch 301 ^/old/page\\.html/?$ https://example.org/new\n" +
+		"RedirectMatch 302 ^/x/?$ https://example.org/x%20y\n" +
+		"RedirectMatch 301 ^/docs/api(/.*)?$ https://api.example.org$1\n" +
+		"RedirectMatch 301 ^/docs(/.*)?$ https://example.org/d$1\n"
+	if apache != want {
+		t.Errorf("apache is\n%s\nwant\n%s", apache, want)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	fileStoreLinks     = "links.json"
+	fileStoreResources = "resources.json"
+	fileStoreCounters  = "counters.json"
+	fileStoreRules     = "rules.json"
+	fileStoreStats     = "stats.jsonl"
+	fileStoreChecks    = "checks.jsonl"
+)
+
+// fileStoreSaveDelay is how long changes made on every click, such as rule hits, and by every check, wait to be saved. A burst of
+// clicks then rewrites links.json once, rather than once per click.
+const fileStoreSaveDelay = time.Second
+
+// defaultFileStoreRetention is how long stats and checks are kept, unless LINKR_STORE_RETENTION says otherwise
+const defaultFileStoreRetention = 90 * 24 * time.Hour
+
+// fileStoreCompactInterval is how often stats.jsonl and checks.jsonl are rewritten without the records that have
+// passed the retention period
+const fileStoreCompactInterval = 24 * time.Hour
+
+// FileStore is a MemoryStore that is saved to a directory on disk, so a small deployment can run
+// without a database server. Links, resources, counters and rules are rewritten as a whole when they change,
+// stats and checks are appended one JSON doc per line and kept for Retention.
+type FileStore struct {
+	*MemoryStore
+	Dir       string
+	Retention time.Duration
+
+	// fmu serialises writes to the files, and compactedAt is when the stats and checks were last compacted
+	fmu         sync.Mutex
+	compactedAt time.Time
+
+	// pending are the saves waiting for fileStoreSaveDelay, by file name
+	pmu     sync.Mutex
+	pending map[string]func() error
+}
+
+// NewFileStore loads any existing data from dir, creating it if needed. Stats and checks older than
+// LINKR_STORE_RETENTION (default 90 days) are left out, and dropped from the files.
+func NewFileStore(dir string) (*FileStore, error) {
+
+	f := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		Dir:         dir,
+		Retention:   envDuration("LINKR_STORE_RETENTION", defaultFileStoreRetention),
+		pending:     make(map[string]func() error),
+		compactedAt: time.Now(),
+	}
+	cutoff := f.compactedAt.Add(-f.Retention)
+	expired := 0
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []LinkDoc
+	err = f.load(fileStoreLinks, &links)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		f.links[l.ShortUrl] = l
+	}
+
+	err = f.load(fileStoreResources, &f.resources)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.load(fileStoreCounters, &f.counters)
+	if err != nil {
+		return nil, err
+	}
+	if f.counters == nil {
+		f.counters = make(map[string]int64)
+	}
+
+	err = f.load(fileStoreRules, &f.rules)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.loadLines(fileStoreStats, func(b []byte) error {
+		s := LinkStatsDoc{}
+		err := json.Unmarshal(b, &s)
+		if err != nil {
+			return err
+		}
+		if s.CreatedAt.Before(cutoff) {
+			expired++
+			return nil
+		}
+		f.stats = append(f.stats, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.loadLines(fileStoreChecks, func(b []byte) error {
+		lc := LinkCheckDoc{}
+		err := json.Unmarshal(b, &lc)
+		if err != nil {
+			return err
+		}
+		if lc.CreatedAt.Before(cutoff) {
+			expired++
+			return nil
+		}
+		f.checks = append(f.checks, lc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if expired > 0 {
+		err = f.compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Loaded %v links from %s\n", len(f.links), dir)
+
+	return f, nil
+}
+
+func (f *FileStore) AddLink(ld LinkDoc) error {
+
+	err := f.MemoryStore.AddLink(ld)
+	if err != nil {
+		return err
+	}
+
+	return f.saveLinks()
+}
+
+func (f *FileStore) UpdateLink(shortUrl string, ld LinkDoc) (LinkDoc, error) {
+
+	ld, err := f.MemoryStore.UpdateLink(shortUrl, ld)
+	if err != nil {
+		return ld, err
+	}
+
+	return ld, f.saveLinks()
+}
+
+func (f *FileStore) DeleteLink(shortUrl string) error {
+
+	err := f.MemoryStore.DeleteLink(shortUrl)
+	if err != nil {
+		return err
+	}
+
+	return f.saveLinks()
+}
+
+func (f *FileStore) IncrementClicks(shortUrl string) error {
+
+	err := f.MemoryStore.IncrementClicks(shortUrl)
+	if err != nil {
+		return err
+	}
+	f.saveSoon(fileStoreLinks, f.saveLinks)
+
+	return nil
+}
+
+func (f *FileStore) RecordStats(s LinkStatsDoc) error {
+
+	// Held across both so a compaction can't write the record out as well
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	err := f.MemoryStore.RecordStats(s)
+	if err != nil {
+		return err
+	}
+	f.compactSoon()
+
+	return f.appendLine(fileStoreStats, s)
+}
+
+func (f *FileStore) UpdateCheckState(shortUrl string, lc LinkCheckDoc, failures int, movedTo string, nextCheckAt time.Time) error {
+
+	err := f.MemoryStore.UpdateCheckState(shortUrl, lc, failures, movedTo, nextCheckAt)
+	if err != nil {
+		return err
+	}
+	f.saveSoon(fileStoreLinks, f.saveLinks)
+
+	return nil
+}
+
+func (f *FileStore) RecordCheck(lc LinkCheckDoc) error {
+
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	err := f.MemoryStore.RecordCheck(lc)
+	if err != nil {
+		return err
+	}
+	f.compactSoon()
+
+	return f.appendLine(fileStoreChecks, lc)
+}
+
+func (f *FileStore) NextSequence(name string) (int64, error) {
+
+	n, err := f.MemoryStore.NextSequence(name)
+	if err != nil {
+		return n, err
+	}
+
+	// Snapshot while holding fmu so an older snapshot can't overwrite a newer one
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	f.mu.RLock()
+	counters := make(map[string]int64, len(f.counters))
+	for k, v := range f.counters {
+		counters[k] = v
+	}
+	f.mu.RUnlock()
+
+	return n, f.save(fileStoreCounters, counters)
+}
+
+func (f *FileStore) SetRules(rules []RuleDoc) error {
+
+	err := f.MemoryStore.SetRules(rules)
+	if err != nil {
+		return err
+	}
+
+	return f.saveRules()
+}
+
+func (f *FileStore) IncrementRuleHits(id bson.ObjectId) error {
+
+	err := f.MemoryStore.IncrementRuleHits(id)
+	if err != nil {
+		return err
+	}
+	f.saveSoon(fileStoreRules, f.saveRules)
+
+	return nil
+}
+
+// compactSoon compacts the stats and checks with the pending saves, if it is fileStoreCompactInterval since they
+// last were. The caller must hold fmu.
+func (f *FileStore) compactSoon() {
+
+	if time.Since(f.compactedAt) >= fileStoreCompactInterval {
+		f.saveSoon(fileStoreStats, f.compact)
+	}
+}
+
+// compact drops the stats and checks that are older than Retention, and rewrites stats.jsonl and checks.jsonl
+// without them
+func (f *FileStore) compact() error {
+
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	f.compactedAt = time.Now()
+	cutoff := f.compactedAt.Add(-f.Retention)
+
+	f.mu.Lock()
+	var stats []LinkStatsDoc
+	for _, s := range f.stats {
+		if !s.CreatedAt.Before(cutoff) {
+			stats = append(stats, s)
+		}
+	}
+	f.stats = stats
+	var checks []LinkCheckDoc
+	for _, lc := range f.checks {
+		if !lc.CreatedAt.Before(cutoff) {
+			checks = append(checks, lc)
+		}
+	}
+	f.checks = checks
+	f.mu.Unlock()
+
+	err := f.saveLines(fileStoreStats, len(stats), func(i int) interface{} { return stats[i] })
+	if err != nil {
+		return err
+	}
+
+	return f.saveLines(fileStoreChecks, len(checks), func(i int) interface{} { return checks[i] })
+}
+
+// saveSoon saves the named file with save after fileStoreSaveDelay, unless a save of it is already waiting
+func (f *FileStore) saveSoon(name string, save func() error) {
+
+	f.pmu.Lock()
+	defer f.pmu.Unlock()
+
+	if _, ok := f.pending[name]; ok {
+		return
+	}
+	f.pending[name] = save
+
+	time.AfterFunc(fileStoreSaveDelay, func() {
+		err := f.savePending(name)
+		if err != nil {
+			log.Printf("Error saving %s: %s\n", name, err)
+		}
+	})
+}
+
+// savePending runs the save waiting for the named file, if there is one. It is taken off the list first, so
+// changes made while it runs are saved again later.
+func (f *FileStore) savePending(name string) error {
+
+	f.pmu.Lock()
+	save, ok := f.pending[name]
+	delete(f.pending, name)
+	f.pmu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return save()
+}
+
+// Flush saves any changes that are waiting to be saved
+func (f *FileStore) Flush() error {
+
+	f.pmu.Lock()
+	var names []string
+	for name := range f.pending {
+		names = append(names, name)
+	}
+	f.pmu.Unlock()
+
+	for _, name := range names {
+		err := f.savePending(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FlushOnExit saves any waiting changes when the process is asked to stop, as Heroku does when it restarts a dyno
+func (f *FileStore) FlushOnExit() {
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		err := f.Flush()
+		if err != nil {
+			log.Println("Error saving on exit:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+}
+
+// saveRules writes out a snapshot of the rules
+func (f *FileStore) saveRules() error {
+
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	rules, _ := f.MemoryStore.Rules()
+
+	return f.save(fileStoreRules, rules)
+}
+
+// saveLinks writes out a snapshot of all the links
+func (f *FileStore) saveLinks() error {
+
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	f.mu.RLock()
+	links := make([]LinkDoc, 0, len(f.links))
+	for _, l := range f.links {
+		links = append(links, l)
+	}
+	f.mu.RUnlock()
+
+	return f.save(fileStoreLinks, links)
+}
+
+// save replaces the named file with v as JSON. The caller must hold fmu.
+func (f *FileStore) save(name string, v interface{}) error {
+
+	js, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return f.replace(name, js)
+}
+
+// saveLines replaces the named file with n docs, got from doc, one JSON doc per line. The caller must hold fmu.
+func (f *FileStore) saveLines(name string, n int, doc func(i int) interface{}) error {
+
+	var b []byte
+	for i := 0; i < n; i++ {
+		js, err := json.Marshal(doc(i))
+		if err != nil {
+			return err
+		}
+		b = append(append(b, js...), '\n')
+	}
+
+	return f.replace(name, b)
+}
+
+// replace writes b to a temp file and renames it over the named file, so that a crash part way through leaves
+// either the old file or the new one, never half of one
+func (f *FileStore) replace(name string, b []byte) error {
+
+	p := filepath.Join(f.Dir, name)
+	err := ioutil.WriteFile(p+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// appendLine adds v as a single line of JSON to the end of the named file. Unlike save it writes in place, so a
+// crash part way through can leave a cut off last line, which loadLines drops. The caller must hold fmu.
+func (f *FileStore) appendLine(name string, v interface{}) error {
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(filepath.Join(f.Dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	_, err = fh.Write(append(js, '\n'))
+
+	return err
+}
+
+// load reads the named file into v, a missing file is not an error
+func (f *FileStore) load(name string, v interface{}) error {
+
+	js, err := ioutil.ReadFile(filepath.Join(f.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(js, v)
+}
+
+// errNoNewline is a last line that appendLine didn't finish
+var errNoNewline = errors.New("no newline at the end")
+
+// loadLines calls fn with each line of the named file, a missing file is not an error. A last line that has no
+// newline or that fn fails on was most likely cut short by a crash in appendLine, so it is logged and cut off the
+// file rather than stopping the store from loading. A bad line anywhere else is an error.
+func (f *FileStore) loadLines(name string, fn func([]byte) error) error {
+
+	p := filepath.Join(f.Dir, name)
+	fh, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	rd := bufio.NewReader(fh)
+	var good int64
+	for {
+		line, rerr := rd.ReadBytes('\n')
+		if rerr == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+
+		err = errNoNewline
+		if rerr == nil {
+			err = fn(line)
+		}
+		if err != nil {
+			if _, perr := rd.Peek(1); perr != io.EOF {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			log.Printf("Dropping the last line of %s: %s\n", name, err)
+			return os.Truncate(p, good)
+		}
+		good += int64(len(line))
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// metadataMarker precedes the metadata map at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// ErrBadGeoIP is returned when a GeoIP database can't be understood
+var ErrBadGeoIP = errors.New("invalid MaxMind DB file")
+
+// MaxMind DB data types, see https://maxmind.github.io/MaxMind-DB/
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// maxMMDBDepth stops a corrupt file with pointer loops or silly nesting from running forever
+const maxMMDBDepth = 32
+
+// GeoIPReader looks up the country of IP addresses in a MaxMind DB (.mmdb) file, such as GeoLite2 Country,
+// which is read into memory. A nil *GeoIPReader finds nothing, so callers needn't check it is configured.
+type GeoIPReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// OpenGeoIP reads the database at path
+func OpenGeoIP(path string) (*GeoIPReader, error) {
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, ErrBadGeoIP
+	}
+	v, _, err := mmdbDecoder(buf[i+len(metadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	md, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrBadGeoIP
+	}
+
+	g := &GeoIPReader{}
+	g.nodeCount, _ = md["node_count"].(uint)
+	g.recordSize, _ = md["record_size"].(uint)
+	g.ipVersion, _ = md["ip_version"].(uint)
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", ErrBadGeoIP, g.recordSize)
+	}
+	if g.ipVersion != 4 && g.ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported IP version %d", ErrBadGeoIP, g.ipVersion)
+	}
+
+	// The search tree, then 16 bytes of zeros, then the data section up to the metadata
+	treeSize := g.recordSize * 2 / 8 * g.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, ErrBadGeoIP
+	}
+	g.tree = buf[:treeSize]
+	g.data = mmdbDecoder(buf[treeSize+16 : i])
+
+	// In an IPv6 database the IPv4 addresses live under ::/96
+	if g.ipVersion == 6 {
+		for n := 0; n < 96 && g.ipv4Start < g.nodeCount; n++ {
+			g.ipv4Start = g.record(g.ipv4Start, 0)
+		}
+	}
+
+	return g, nil
+}
+
+// Country returns the ISO 3166 country code for ip, or "" if it isn't known. Where the database has no
+// country for an address, such as for anonymous proxies, the registered country is used.
+func (g *GeoIPReader) Country(ip string) string {
+
+	if g == nil {
+		return ""
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	node, bits := uint(0), 128
+	if v4 := addr.To4(); v4 != nil {
+		addr, node, bits = v4, g.ipv4Start, 32
+	} else if g.ipVersion == 4 {
+		return ""
+	}
+
+	for i := 0; i < bits && node < g.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = g.record(node, bit)
+	}
+	if node <= g.nodeCount {
+		return ""
+	}
+
+	v, _, err := g.data.decode(node-g.nodeCount-16, 0)
+	if err != nil {
+		return ""
+	}
+	rec, _ := v.(map[string]interface{})
+	for _, k := range []string{"country", "registered_country"} {
+		c, _ := rec[k].(map[string]interface{})
+		if code, ok := c["iso_code"].(string); ok && code != "" {
+			return code
+		}
+	}
+
+	return ""
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node in the search tree
+func (g *GeoIPReader) record(node, bit uint) uint {
+
+	switch g.recordSize {
+	case 24:
+		b := g.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := g.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+
+	b := g.tree[node*8+bit*4:]
+	return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+}
+
+// mmdbDecoder decodes values from a MaxMind DB data section. Maps become map[string]interface{}, arrays
+// []interface{}, and unsigned integers uint.
+type mmdbDecoder []byte
+
+// decode returns the value at off and the offset of whatever follows it
+func (d mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+
+	if depth > maxMMDBDepth || off >= uint(len(d)) {
+		return nil, 0, ErrBadGeoIP
+	}
+
+	ctrl := d[off]
+	off++
+	typ := uint(ctrl >> 5)
+
+	// A pointer's value is elsewhere in the data section, and decoding carries on after the pointer itself
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+
+	if typ == mmdbExtended {
+		if off >= uint(len(d)) {
+			return nil, 0, ErrBadGeoIP
+		}
+		typ = 7 + uint(d[off])
+		off++
+	}
+
+	size, off, err := d.size(ctrl, off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			k, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, ErrBadGeoIP
+			}
+			m[key] = v
+		}
+		return m, off, nil
+
+	case mmdbArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+
+	// Everything else is size bytes long
+	if off+size > uint(len(d)) {
+		return nil, 0, ErrBadGeoIP
+	}
+	b := d[off : off+size]
+	off += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, ErrBadGeoIP
+		}
+		return math.Float64frombits(beUint(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, ErrBadGeoIP
+		}
+		return math.Float32frombits(uint32(beUint(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		return uint(beUint(b)), off, nil
+	case mmdbInt32:
+		return int32(uint32(beUint(b))), off, nil
+	case mmdbUint128:
+		// Too big for a uint and nothing here needs one
+		return append([]byte(nil), b...), off, nil
+	}
+
+	return nil, 0, fmt.Errorf("%s: unexpected data type %d", ErrBadGeoIP, typ)
+}
+
+// size reads the payload size from a control byte and up to three following bytes
+func (d mmdbDecoder) size(ctrl byte, off uint) (uint, uint, error) {
+
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, off, nil
+	}
+
+	n := size - 28
+	if off+n > uint(len(d)) {
+		return 0, 0, ErrBadGeoIP
+	}
+	v := uint(beUint(d[off : off+n]))
+
+	switch size {
+	case 29:
+		size = 29 + v
+	case 30:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+
+	return size, off + n, nil
+}
+
+// pointer reads a pointer, which is an offset from the start of the data section
+func (d mmdbDecoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+
+	ss := uint(ctrl>>3) & 3
+	n := ss + 1
+	if off+n > uint(len(d)) {
+		return 0, 0, ErrBadGeoIP
+	}
+
+	p := uint(ctrl & 7)
+	if ss == 3 {
+		p = 0
+	}
+	for _, b := range d[off : off+n] {
+		p = p<<8 | uint(b)
+	}
+
+	switch ss {
+	case 1:
+		p += 2048
+	case 2:
+		p += 526336
+	}
+
+	return p, off + n, nil
+}
+
+// beUint reads a big endian unsigned integer of up to 8 bytes
+func beUint(b []byte) uint64 {
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
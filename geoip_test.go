@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMMDBDecode(t *testing.T) {
+
+	for _, c := range []struct {
+		hex  string
+		want interface{}
+	}{
+		{"a0", uint(0)},
+		{"a201f4", uint(500)},
+		{"a2ffff", uint(65535)},
+		{"c3ffffff", uint(16777215)},
+		{"c4ffffffff", uint(4294967295)},
+		{"0002", uint(0)},
+		{"0802ffffffffffffffff", uint(18446744073709551615)},
+		{"0001", int32(0)},
+		{"0401ffffffff", int32(-1)},
+		{"0401f0000001", int32(-268435455)},
+		{"0007", false},
+		{"0107", true},
+		{"680000000000000000", 0.0},
+		{"683fe0000000000000", 0.5},
+		{"68405ec00000000000", 123.0},
+		{"04083f800000", float32(1.0)},
+		{"40", ""},
+		{"4131", "1"},
+		{"43e4baba", "人"},
+		{"5b" + strings.Repeat("78", 27), strings.Repeat("x", 27)},
+		{"5d00" + strings.Repeat("78", 29), strings.Repeat("x", 29)},
+		{"5d01" + strings.Repeat("78", 30), strings.Repeat("x", 30)},
+		{"5e0000" + strings.Repeat("78", 285), strings.Repeat("x", 285)},
+		{"5f000000" + strings.Repeat("78", 65821), strings.Repeat("x", 65821)},
+		{"e0", map[string]interface{}{}},
+		{"e142656e43466f6f", map[string]interface{}{"en": "Foo"}},
+		{"e242656e43466f6f427a6843e4baba", map[string]interface{}{"en": "Foo", "zh": "人"}},
+		{"020443466f6f43e4baba", []interface{}{"Foo", "人"}},
+	} {
+		b, _ := hex.DecodeString(c.hex)
+		v, next, err := mmdbDecoder(b).decode(0, 0)
+		if err != nil || !reflect.DeepEqual(v, c.want) || next != uint(len(b)) {
+			name := c.hex
+			if len(name) > 20 {
+				name = name[:20] + "..."
+			}
+			t.Errorf("%s: %#v, %v, %v, want %#v", name, v, next, err, c.want)
+		}
+	}
+}
+
+func TestMMDBDecodeBad(t *testing.T) {
+
+	for _, h := range []string{
+		"",
+		"44666f",   // string longer than the data
+		"e1426565", // map with a key and no value
+		"e1a0a0",   // map key that isn't a string
+		"5d",       // size byte missing
+		"2000",     // pointer to itself
+	} {
+		b, _ := hex.DecodeString(h)
+		if _, _, err := mmdbDecoder(b).decode(0, 0); err == nil {
+			t.Errorf("%s: no error", h)
+		}
+	}
+}
+
+func TestMMDBPointer(t *testing.T) {
+
+	for _, c := range []struct {
+		hex  string
+		want uint
+	}{
+		{"2000", 0},
+		{"2205", 517},
+		{"27ff", 2047},
+		{"280000", 2048},
+		{"2fffff", 526335},
+		{"30000000", 526336},
+		{"37ffffff", 134744063},
+		{"38ffffffff", 4294967295},
+	} {
+		b, _ := hex.DecodeString(c.hex)
+		p, next, err := mmdbDecoder(b).pointer(b[0], 1)
+		if err != nil || p != c.want || next != uint(len(b)) {
+			t.Errorf("%s: %v, %v, %v, want %v", c.hex, p, next, err, c.want)
+		}
+	}
+}
+
+func TestGeoIPRecord(t *testing.T) {
+
+	for _, c := range []struct {
+		size        uint
+		hex         string
+		left, right uint
+	}{
+		{24, "123456789abc", 0x123456, 0x789abc},
+		{28, "123456ab789abc", 0xa123456, 0xb789abc},
+		{32, "123456789abcdef0", 0x12345678, 0x9abcdef0},
+	} {
+		b, _ := hex.DecodeString(c.hex)
+		g := &GeoIPReader{tree: b, recordSize: c.size}
+		if l, r := g.record(0, 0), g.record(0, 1); l != c.left || r != c.right {
+			t.Errorf("%d bit records: %x, %x, want %x, %x", c.size, l, r, c.left, c.right)
+		}
+	}
+}
+
+// encodeMMDBString, encodeMMDBMap and encodeMMDBUint16 encode small values for a test database
+func encodeMMDBString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func encodeMMDBMap(kv ...[]byte) []byte {
+
+	b := []byte{0xe0 | byte(len(kv)/2)}
+	for _, x := range kv {
+		b = append(b, x...)
+	}
+
+	return b
+}
+
+func encodeMMDBUint16(n uint) []byte {
+	return []byte{0xa2, byte(n >> 8), byte(n)}
+}
+
+// writeMMDB writes a database with the search tree nodes, each a left and right record, and data, returning its path
+func writeMMDB(t *testing.T, recordSize, ipVersion uint, nodes [][2]uint, data []byte) string {
+
+	var b []byte
+	for _, n := range nodes {
+		l, r := n[0], n[1]
+		switch recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			// The middle byte has the top 4 bits of each record
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>20)&0xf0|byte(r>>24)&0x0f,
+				byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			b = append(b, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	b = append(b, encodeMMDBMap(
+		encodeMMDBString("node_count"), encodeMMDBUint16(uint(len(nodes))),
+		encodeMMDBString("record_size"), encodeMMDBUint16(recordSize),
+		encodeMMDBString("ip_version"), encodeMMDBUint16(ipVersion),
+	)...)
+
+	f, err := ioutil.TempFile("", "linkr-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+// geoIPTestNZ has a country and geoIPTestUS only a registered country, and geoIPTestData is one then the other
+var (
+	geoIPTestNZ   = encodeMMDBMap(encodeMMDBString("country"), encodeMMDBMap(encodeMMDBString("iso_code"), encodeMMDBString("NZ")))
+	geoIPTestUS   = encodeMMDBMap(encodeMMDBString("registered_country"), encodeMMDBMap(encodeMMDBString("iso_code"), encodeMMDBString("US")))
+	geoIPTestData = append(append([]byte{}, geoIPTestNZ...), geoIPTestUS...)
+)
+
+func testCountries(t *testing.T, path string, want map[string]string) {
+
+	defer os.Remove(path)
+	g, err := OpenGeoIP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, c := range want {
+		if got := g.Country(ip); got != c {
+			t.Errorf("%s: %q, want %q", ip, got, c)
+		}
+	}
+}
+
+func TestGeoIPv4(t *testing.T) {
+
+	// 0.0.0.0/2 has nothing, 64.0.0.0/2 is NZ and 128.0.0.0/1 US
+	nz, us := uint(2+16), uint(2+16+len(geoIPTestNZ))
+	for _, size := range []uint{24, 28, 32} {
+		path := writeMMDB(t, size, 4, [][2]uint{{1, us}, {2, nz}}, geoIPTestData)
+		testCountries(t, path, map[string]string{
+			"64.1.2.3":        "NZ",
+			"127.255.0.1":     "NZ",
+			"200.1.1.1":       "US",
+			"10.0.0.1":        "",
+			"2001:db8::1":     "",
+			"not an ip":       "",
+			"::ffff:64.0.0.1": "NZ",
+		})
+	}
+}
+
+func TestGeoIPv6(t *testing.T) {
+
+	// ::/96 is a chain of left records down to the IPv4 tree at node 96, which is as in TestGeoIPv4, and
+	// 8000::/1 is NZ
+	const count = 98
+	nz, us := uint(count+16), uint(count+16+len(geoIPTestNZ))
+	nodes := make([][2]uint, count)
+	for i := 0; i < 96; i++ {
+		nodes[i] = [2]uint{uint(i + 1), count}
+	}
+	nodes[0][1] = nz
+	nodes[96] = [2]uint{97, us}
+	nodes[97] = [2]uint{count, nz}
+
+	testCountries(t, writeMMDB(t, 24, 6, nodes, geoIPTestData), map[string]string{
+		"64.1.2.3":    "NZ",
+		"200.1.1.1":   "US",
+		"10.0.0.1":    "",
+		"8000::1":     "NZ",
+		"2001:db8::1": "",
+	})
+}
+
+func TestGeoIPNil(t *testing.T) {
+
+	var g *GeoIPReader
+	if c := g.Country("64.1.2.3"); c != "" {
+		t.Errorf("nil reader found %q", c)
+	}
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -19,33 +18,59 @@ const maxRedirects = 30
 
 const defaultResultCount = 20
 
+// trendingWindows are the periods trending links can be counted over
+var trendingWindows = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+const defaultTrendingWindow = "7d"
+
 type Link struct {
-	ShortURL string `json:shortUrl`
-	LongURL  string `json:longUrl`
+	ShortURL string `json:"shortUrl"`
+	LongURL  string `json:"longUrl"`
 }
 
 type APIResponse struct {
-	StatusMessage string `json:statusmessage`
+	StatusMessage string `json:"statusMessage"`
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/popular.html", http.StatusSeeOther)
+	http.Redirect(w, r, namespacePath(r)+"/popular.html", http.StatusSeeOther)
+}
+
+// namespacePath is "/" and the namespace of a namespace listing, or "" for the root
+func namespacePath(r *http.Request) string {
+
+	if ns := mux.Vars(r)["namespace"]; ns != "" {
+		return "/" + ns
+	}
+
+	return ""
 }
 
 // RedirectHandler redirects the request to the target long url
 func RedirectHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get short url from path
-	vars := mux.Vars(r)
-	sUrl := vars["shortUrl"]
+	redirectPath(w, r, mux.Vars(r)["shortUrl"])
+}
+
+// redirectPath redirects the request for sUrl, the path without the leading slash, to the target long url
+func redirectPath(w http.ResponseWriter, r *http.Request, sUrl string) {
 
 	if len(sUrl) > 0 {
 
 		fmt.Printf("Looking for %s... ", sUrl)
 
-		// Get link doc from db
-		ld, err := MongoDB.FindLink(sUrl)
-		if err == mgo.ErrNotFound {
+		// Get link doc from db, this link or a prefix link that covers it
+		ld, err := findLinkForPath(sUrl)
+		if err == ErrNotFound {
+			// No link, but a rule may cover the path
+			if ruleRedirect(w, r, "/"+sUrl) {
+				return
+			}
 			fmt.Println("not found")
 			msg := fmt.Sprintf("The link /%s could not be found in the database.", sUrl)
 			tpl.ExecuteTemplate(w, "error", msg)
@@ -67,129 +92,163 @@ func RedirectHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Found
-		fmt.Println(" -> ", ld.LongUrl)
+		// Outside the dates it is live, or used up
+		switch linkAvailability(ld, time.Now()) {
+		case linkNotYetActive:
+			fmt.Println("not yet active")
+			w.WriteHeader(http.StatusNotFound)
+			tpl.ExecuteTemplate(w, "soon", ld)
+			return
+		case linkExpired:
+			fmt.Println("expired")
+			w.WriteHeader(http.StatusGone)
+			tpl.ExecuteTemplate(w, "expired", ld)
+			return
+		}
 
-		// Increment clicks regardless... a click is a click
-		go MongoDB.IncrementClicks(ld.ShortUrl)
+		// Password protected, so only go on if they have given the password
+		if ld.PasswordHash != "" && !passwordGate(w, r, ld) {
+			return
+		}
 
-		// Check URL in a Go routine so no waiting... previously we waited and if the site was good the lastStatusCode
-		// was changed before redirecting the user. The issue was that some sites had many redirects so the check took
-		// a long time, then the actual redirect took a long time - painful. So now the check is done independently
-		// and if there was an issue previously the user is shown a direct link straight away.
-		go checkURL(r, &ld)
+		// Found, so where to? Usually the longUrl but the link may have a schedule, device, country or language
+		// rules, or an A/B split
+		dest, variant := destination(w, r, ld)
+		if ld.Prefix {
+			dest = forwardPath(dest, strings.TrimPrefix(r.URL.EscapedPath(), "/"+ld.ShortUrl))
+		}
+		dest = redirectURL(dest, r, ld)
+		fmt.Println(" -> ", dest)
 
-		// If the last status was 200 - OK, or 0 for first access, redirect immediately to save time.
-		// If the subsequent check finds the link is broken then only the first user will see the "hang" or 404.
-		// Subsequent users will see the direct link page. This is a faster user experience as the url check happens
-		// is independent (see above).
-		if ld.LastStatusCode == 200 || ld.LastStatusCode == 0 {
-			http.Redirect(w, r, ld.LongUrl, http.StatusSeeOther)
+		// Increment clicks regardless... a click is a click. A HEAD isn't though, it is a bot or a link checker.
+		if r.Method != "HEAD" {
+			go Store.IncrementClicks(ld.ShortUrl)
+
+			// Record the click
+			stats := newLinkStats(r, ld.ID)
+			stats.Variant = variant
+			go recordStats(stats)
+		}
+
+		// The url is checked by the LinkChecker on its own schedule, so clicks never wait on it. A link that has
+		// never been checked is queued now so that its status is known quickly.
+		if ld.LastCheckedAt.IsZero() && Checker != nil {
+			Checker.Enqueue(ld)
+		}
+
+		// If the last status was 200 - OK, or 0 for not yet checked, redirect immediately.
+		// Otherwise there was an issue last time the link was checked so show the direct link page. That page is
+		// only any use to a person, so other methods always redirect - an API endpoint that only takes a POST
+		// will check as 405 anyway.
+		if ld.LastStatusCode == 200 || ld.LastStatusCode == 0 || r.Method != "GET" {
+			http.Redirect(w, r, dest, redirectType(ld))
 			return
 		}
 
-		tpl.ExecuteTemplate(w, "direct", ld.LongUrl)
+		tpl.ExecuteTemplate(w, "direct", dest)
 	}
 }
 
-func checkURL(r *http.Request, ld *LinkDoc) {
+// validRedirectTypes are the status codes a link may redirect with. 301 and 302 let clients change a POST to a
+// GET, 303 always does, and 307 and 308 keep the method and body.
+var validRedirectTypes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
 
-	fmt.Println("Go routine checking URL ", ld.LongUrl)
+// redirectType is the status code to redirect to ld with, its own or the default from LINKR_REDIRECT_TYPE
+func redirectType(ld LinkDoc) int {
 
-	// LinkStats
-	stats := LinkStatsDoc{
-		ID:        bson.NewObjectId(),
-		LinkID:    ld.ID,
-		CreatedAt: time.Now(),
-		Referrer:  r.Referer(),
-		Agent:     r.UserAgent(),
+	if ld.RedirectType != 0 {
+		return ld.RedirectType
 	}
 
-	// Check link is UP, if it isn't we can record the status. Note that this fancy client
-	// function is here because one link had more than 10 redirects at the remote end.
-	// So this allows us to up the limit (10 is Go default)... it came from here:
-	// https://gist.github.com/VojtechVitek/eb0171fc65f945a8641e
-
-	// This stuff was an attempt to work around some remote servers resetting the connection from the
-	// Go http client, however the urls were fine from a browser.
-	//cfg := &tls.Config{
-	//	MinVersion: tls.VersionTLS12,
-	//	//MinVersion:         0,
-	//	InsecureSkipVerify: true,
-	//}
-	//var netTransport = &http.Transport{
-	//	//Dial: (&net.Dialer{
-	//	//	Timeout: 10 * time.Second,
-	//	//}).Dial,
-	//	//TLSHandshakeTimeout: 10 * time.Second,
-	//	TLSClientConfig: cfg,
-	//}
+	return DefaultRedirectType
+}
 
-	client := &http.Client{
-		Timeout: time.Second * 30,
-		//Transport: netTransport,
-		CheckRedirect: func() func(req *http.Request, via []*http.Request) error {
-			redirects := 0
-			return func(req *http.Request, via []*http.Request) error {
-				if redirects > maxRedirects {
-					fmt.Printf("Checking target url had %v redirects\n", redirects)
-					msg := fmt.Sprintf("More than %v redirects", maxRedirects)
-					return errors.New(msg)
-				}
-				redirects++
-				return nil
-			}
-		}(),
+// publicLink hides the password hash and, for a password protected link, the destinations. The detail of the last
+// check error is hidden too, as it may name the destination, or quote the page's title.
+func publicLink(ld LinkDoc) LinkDoc {
+
+	if ld.PasswordHash != "" {
+		ld.LongUrl = ""
+		ld.MovedTo = ""
+		ld.LastError = ""
+		ld.Targets = nil
+		ld.GeoTargets = nil
+		ld.Languages = nil
+		ld.Variants = nil
+		ld.Schedule = nil
 	}
+	ld.PasswordHash = ""
 
-	//res, err := client.Head(ld.LongUrl)
-	res, err := client.Get(ld.LongUrl)
-	if err != nil {
+	return ld
+}
 
-		// 'res' is nil so set status here..
-		fmt.Println("Error checking long url:", err)
+func publicLinks(lds []LinkDoc) []LinkDoc {
 
-		// No server response / timeout
-		stats.StatusCode = http.StatusGatewayTimeout
+	for i := range lds {
+		lds[i] = publicLink(lds[i])
+	}
 
-		err = MongoDB.UpdateStatusCode(ld.ShortUrl, stats.StatusCode)
-		if err != nil {
-			fmt.Println("Error updating status code:", err)
-		}
+	return lds
+}
 
-		// Record LinkStats doc
-		err = MongoDB.RecordStats(stats)
-		if err != nil {
-			fmt.Println("Error recording stats:", err)
-		}
+// Link availability, from linkAvailability
+const (
+	linkAvailable = iota
+	linkNotYetActive
+	linkExpired
+)
 
-		return
-	}
+// linkAvailability works out whether an active link is live at time t, given its activeFrom, expiresAt and maxClicks.
+// The clicks counter is incremented in the background, so a burst of clicks may slightly overshoot maxClicks.
+func linkAvailability(ld LinkDoc, t time.Time) int {
 
-	// Got a response
-	defer res.Body.Close()
-	fmt.Println("HTTP Response: ", res.Status)
-	stats.StatusCode = res.StatusCode
+	if ld.ActiveFrom != nil && t.Before(*ld.ActiveFrom) {
+		return linkNotYetActive
+	}
+	if ld.ExpiresAt != nil && !t.Before(*ld.ExpiresAt) {
+		return linkExpired
+	}
+	if ld.MaxClicks > 0 && ld.Clicks >= ld.MaxClicks {
+		return linkExpired
+	}
 
-	// Update lastStatusCode in Link if it is unset (0) or changed
-	if ld.LastStatusCode == 0 || stats.StatusCode != ld.LastStatusCode {
+	return linkAvailable
+}
 
-		msg := fmt.Sprintf("Updating last status code for %s from %v to %v\n", ld.ShortUrl, ld.LastStatusCode, stats.StatusCode)
-		fmt.Println(msg)
+// newLinkStats sets up the LinkStatsDoc for a click on the link, or rule, with the given id
+func newLinkStats(r *http.Request, linkID bson.ObjectId) LinkStatsDoc {
 
-		err = MongoDB.UpdateStatusCode(ld.ShortUrl, stats.StatusCode)
-		if err != nil {
-			fmt.Println("Error updating status code:", err)
-		}
+	return LinkStatsDoc{
+		ID:        bson.NewObjectId(),
+		LinkID:    linkID,
+		CreatedAt: time.Now(),
+		Referrer:  r.Referer(),
+		Agent:     r.UserAgent(),
+		Country:   GeoIP.Country(clientIP(r)),
 	}
+}
+
+// recordStats stores a click, logging rather than returning any error as it is run in a Go routine
+func recordStats(stats LinkStatsDoc) {
 
-	// Record LinkStats doc
-	err = MongoDB.RecordStats(stats)
+	err := Store.RecordStats(stats)
 	if err != nil {
 		fmt.Println("Error recording stats:", err)
 	}
 }
 
+// linkJSON is the JSON view of a link
+type linkJSON struct {
+	LinkDoc
+	ActiveSchedule *ScheduleEntry `json:"activeSchedule,omitempty"`
+}
+
 // JSONHandler responds with the JSON info about the link
 func JSONHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -200,7 +259,7 @@ func JSONHandler(w http.ResponseWriter, r *http.Request) {
 	if len(sUrl) > 0 {
 
 		// Get link doc from db
-		ld, err := MongoDB.FindLink(sUrl)
+		ld, err := Store.FindLink(sUrl)
 		if err != nil {
 			fmt.Println("not found")
 			msg := fmt.Sprintf("The link /%s could not be found in the database.", sUrl)
@@ -208,8 +267,14 @@ func JSONHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Along with the link, the schedule entry in effect now, if any
+		lj := linkJSON{LinkDoc: publicLink(ld)}
+		if i := activeSchedule(lj.LinkDoc, time.Now()); i >= 0 {
+			lj.ActiveSchedule = &lj.Schedule[i]
+		}
+
 		var js interface{}
-		js, err = json.Marshal(ld)
+		js, err = json.Marshal(lj)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -223,17 +288,51 @@ func JSONHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ChecksJSONHandler responds with the recent check history of a link, newest first
+func ChecksJSONHandler(w http.ResponseWriter, r *http.Request) {
+
+	sUrl := mux.Vars(r)["shortUrl"]
+
+	ld, err := Store.FindLink(sUrl)
+	if err == ErrNotFound {
+		writeJSON(w, http.StatusNotFound, APIResponse{fmt.Sprintf("The link /%s could not be found", sUrl)})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lc, err := Store.Checks(ld.ID, queryLimit(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Where a password protected link ends up, how it gets there and what went wrong there, is as secret as its
+	// longUrl. The error class is still shown.
+	if ld.PasswordHash != "" {
+		for i := range lc {
+			lc[i].FinalUrl = ""
+			lc[i].Redirects = nil
+			lc[i].Error = ""
+		}
+	}
+
+	writeJSON(w, http.StatusOK, lc)
+}
+
 // Popular shows the most popular links
 func PopularJSONHandler(w http.ResponseWriter, r *http.Request) {
 
-	ld, err := MongoDB.Popular(defaultResultCount)
+	ld, err := Store.Popular(mux.Vars(r)["namespace"], defaultResultCount)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	var js interface{}
-	js, err = json.Marshal(ld)
+	js, err = json.Marshal(publicLinks(ld))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -248,19 +347,11 @@ func PopularJSONHandler(w http.ResponseWriter, r *http.Request) {
 func PopularHTMLHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get n from the url if there, otherwise default to defaultResultCount
-	q := r.URL.Query()
-	ns, ok := q["n"] /// n is a slice
-	limit := defaultResultCount      // default
-	var err error
-	if ok {
-		limit, err = strconv.Atoi(ns[0])
-		if err != nil {
-			limit = defaultResultCount // if the number in query string is bung
-		}
-	}
+	limit := queryLimit(r)
 
 	// Get the link docs
-	ld, err := MongoDB.Popular(limit)
+	ns := mux.Vars(r)["namespace"]
+	ld, err := Store.Popular(ns, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -277,6 +368,9 @@ func PopularHTMLHandler(w http.ResponseWriter, r *http.Request) {
 	pageData := make(map[string]interface{})
 	pageData["Title"] = "Popular Links"
 	pageData["Heading"] = fmt.Sprintf("%v Most Popular Links", limit)
+	if ns != "" {
+		pageData["Heading"] = fmt.Sprintf("%v Most Popular Links in %s", limit, ns)
+	}
 	pageData["BaseUrl"] = os.Getenv("LINKR_BASE_URL")
 	pageData["Links"] = ld
 
@@ -287,23 +381,71 @@ func PopularHTMLHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// TrendingJSONHandler responds with the links that have the most clicks in a recent window
+func TrendingJSONHandler(w http.ResponseWriter, r *http.Request) {
+
+	window, ok := trendingWindows[trendingWindow(r)]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"window must be one of 24h, 7d or 30d"})
+		return
+	}
+
+	tl, err := Store.Trending(time.Now().Add(-window), queryLimit(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range tl {
+		tl[i].LinkDoc = publicLink(tl[i].LinkDoc)
+	}
+
+	writeJSON(w, http.StatusOK, tl)
+}
+
+// TrendingHTMLHandler shows the trending links in an HTML template
+func TrendingHTMLHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get n from the url if there, otherwise default to defaultResultCount
+	limit := queryLimit(r)
+
+	ws := trendingWindow(r)
+	window, ok := trendingWindows[ws]
+	if !ok {
+		tpl.ExecuteTemplate(w, "error", "The trending window must be one of 24h, 7d or 30d")
+		return
+	}
+
+	tl, err := Store.Trending(time.Now().Add(-window), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Set up some page data
+	pageData := make(map[string]interface{})
+	pageData["Title"] = "Trending Links"
+	pageData["Heading"] = fmt.Sprintf("%v Trending Links", limit)
+	pageData["BaseUrl"] = os.Getenv("LINKR_BASE_URL")
+	pageData["Window"] = ws
+	pageData["Windows"] = []string{"24h", "7d", "30d"}
+	pageData["Links"] = tl
+
+	// Serve it up
+	err = tpl.ExecuteTemplate(w, "trending", pageData)
+	if err != nil {
+		log.Printf("template execution: %s", err)
+	}
+}
+
 // LatestHTMLHandler shows recently added links in an HTML template
 func LatestHTMLHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get n from the url if there, otherwise default to defaultResultCount
-	q := r.URL.Query()
-	ns, ok := q["n"] /// n is a slice
-	limit := defaultResultCount      // default
-	var err error
-	if ok {
-		limit, err = strconv.Atoi(ns[0])
-		if err != nil {
-			limit = defaultResultCount // if the number in query string is bung
-		}
-	}
+	limit := queryLimit(r)
 
 	// Get the latest Resources
-	rd, err := MongoDB.Latest(limit)
+	ns := mux.Vars(r)["namespace"]
+	rd, err := Store.Latest(ns, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -313,6 +455,10 @@ func LatestHTMLHandler(w http.ResponseWriter, r *http.Request) {
 	pageData := make(map[string]interface{})
 	pageData["Title"] = "Latest Resources"
 	pageData["Heading"] = fmt.Sprintf("%v Latest Resources", limit)
+	if ns != "" {
+		pageData["Heading"] = fmt.Sprintf("%v Latest Resources in %s", limit, ns)
+	}
+	pageData["BaseUrl"] = os.Getenv("LINKR_BASE_URL")
 	pageData["Resources"] = rd
 
 	// Serve it up
@@ -322,17 +468,18 @@ func LatestHTMLHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// BrokenJSONHandler shows links with LastStatsCode other than 200
+// BrokenJSONHandler shows links with LastStatsCode other than 200, or that are soft broken, with the class and detail
+// of the failure
 func BrokenJSONHandler(w http.ResponseWriter, r *http.Request) {
 
-	ld, err := MongoDB.Broken()
+	ld, err := Store.Broken()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	var js interface{}
-	js, err = json.Marshal(ld)
+	js, err = json.Marshal(publicLinks(ld))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -342,3 +489,54 @@ func BrokenJSONHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, private, max-age=0")
 	w.Write(js.([]byte))
 }
+
+// BrokenHTMLHandler shows the broken links in an HTML template, with why their last check failed
+func BrokenHTMLHandler(w http.ResponseWriter, r *http.Request) {
+
+	ld, err := Store.Broken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Set up some page data
+	pageData := make(map[string]interface{})
+	pageData["Title"] = "Broken Links"
+	pageData["Heading"] = fmt.Sprintf("%v Broken Links", len(ld))
+	pageData["BaseUrl"] = os.Getenv("LINKR_BASE_URL")
+	pageData["Links"] = publicLinks(ld)
+
+	// Serve it up
+	err = tpl.ExecuteTemplate(w, "broken", pageData)
+	if err != nil {
+		log.Printf("template execution: %s", err)
+	}
+}
+
+// queryLimit gets n from the url if there, otherwise defaults to defaultResultCount
+func queryLimit(r *http.Request) int {
+
+	q := r.URL.Query()
+	ns, ok := q["n"] // n is a slice
+	if !ok {
+		return defaultResultCount
+	}
+
+	limit, err := strconv.Atoi(ns[0])
+	if err != nil || limit <= 0 {
+		return defaultResultCount // if the number in query string is bung
+	}
+
+	return limit
+}
+
+// trendingWindow gets the window from the url if there, otherwise defaults to defaultTrendingWindow
+func trendingWindow(r *http.Request) string {
+
+	ws := r.URL.Query().Get("window")
+	if ws == "" {
+		return defaultTrendingWindow
+	}
+
+	return ws
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLinkAvailability(t *testing.T) {
+
+	now := time.Now()
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, c := range []struct {
+		name string
+		ld   LinkDoc
+		want int
+	}{
+		{"no limits", LinkDoc{}, linkAvailable},
+		{"from before now", LinkDoc{ActiveFrom: &before}, linkAvailable},
+		{"from now", LinkDoc{ActiveFrom: &now}, linkAvailable},
+		{"from later", LinkDoc{ActiveFrom: &after}, linkNotYetActive},
+		{"expires later", LinkDoc{ExpiresAt: &after}, linkAvailable},
+		{"expires now", LinkDoc{ExpiresAt: &now}, linkExpired},
+		{"expired", LinkDoc{ExpiresAt: &before}, linkExpired},
+		{"between", LinkDoc{ActiveFrom: &before, ExpiresAt: &after}, linkAvailable},
+		{"clicks left", LinkDoc{MaxClicks: 3, Clicks: 2}, linkAvailable},
+		{"clicks used up", LinkDoc{MaxClicks: 3, Clicks: 3}, linkExpired},
+		{"clicks over", LinkDoc{MaxClicks: 3, Clicks: 4}, linkExpired},
+		{"not yet, and used up", LinkDoc{ActiveFrom: &after, MaxClicks: 1, Clicks: 1}, linkNotYetActive},
+	} {
+		if got := linkAvailability(c.ld, now); got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUnavailableLinks(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		earlier := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		for _, body := range []string{
+			`{"shortUrl": "soon", "longUrl": "https://example.org/soon", "activeFrom": "` + later + `"}`,
+			`{"shortUrl": "gone", "longUrl": "https://example.org/gone", "expiresAt": "` + earlier + `"}`,
+			`{"shortUrl": "twice", "longUrl": "https://example.org/twice", "maxClicks": 2}`,
+		} {
+			if w := serve("POST", "/api/links", body); w.Code != http.StatusCreated {
+				t.Fatalf("create: status %v, %s", w.Code, w.Body)
+			}
+		}
+
+		for _, c := range []struct {
+			path   string
+			status int
+			page   string
+		}{
+			{"/soon", http.StatusNotFound, "Coming soon"},
+			{"/gone", http.StatusGone, "This link has expired"},
+			{"/twice", http.StatusSeeOther, ""},
+		} {
+			w := serve("GET", c.path, "")
+			if w.Code != c.status || !strings.Contains(w.Body.String(), c.page) {
+				t.Errorf("%s: status %v, want %v with %q", c.path, w.Code, c.status, c.page)
+			}
+		}
+
+		// Gone once the clicks are used up
+		serve("GET", "/twice", "")
+		waitForClicks(t, "twice", 2)
+		if w := serve("GET", "/twice", ""); w.Code != http.StatusGone {
+			t.Errorf("/twice after two clicks: status %v, want %v", w.Code, http.StatusGone)
+		}
+	})
+}
+
+func TestTrending(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		// Clicks in the last day, and earlier, for each link
+		now := time.Now()
+		for _, c := range []struct {
+			shortUrl     string
+			today, month int
+		}{
+			{"steady", 1, 9},
+			{"hot", 4, 0},
+			{"warm", 2, 2},
+			{"cold", 0, 5},
+			{"secret", 3, 0},
+		} {
+			ld := LinkDoc{ID: bson.NewObjectId(), ShortUrl: c.shortUrl, LongUrl: "https://example.org/" + c.shortUrl}
+			if c.shortUrl == "secret" {
+				ld.PasswordHash = "hash"
+			}
+			Store.AddLink(ld)
+			for i := 0; i < c.today+c.month; i++ {
+				at := now.Add(-time.Hour)
+				if i >= c.today {
+					at = now.Add(-10 * 24 * time.Hour)
+				}
+				Store.RecordStats(LinkStatsDoc{ID: bson.NewObjectId(), LinkID: ld.ID, CreatedAt: at})
+			}
+		}
+
+		for _, c := range []struct {
+			query, want string
+		}{
+			{"", "hot 4, secret 3, warm 2, steady 1"},
+			{"?window=24h", "hot 4, secret 3, warm 2, steady 1"},
+			{"?window=30d", "steady 10, cold 5, hot 4, warm 4, secret 3"},
+			{"?window=30d&n=2", "steady 10, cold 5"},
+			{"?n=bung", "hot 4, secret 3, warm 2, steady 1"},
+		} {
+			w := serve("GET", "/trending.json"+c.query, "")
+			var tl []TrendingLink
+			json.NewDecoder(w.Body).Decode(&tl)
+			var got []string
+			for _, l := range tl {
+				got = append(got, fmt.Sprintf("%s %v", l.ShortUrl, l.RecentClicks))
+				if l.PasswordHash != "" || (l.ShortUrl == "secret" && l.LongUrl != "") {
+					t.Errorf("%s: %s isn't hidden", c.query, l.ShortUrl)
+				}
+			}
+			if strings.Join(got, ", ") != c.want {
+				t.Errorf("%s: %v, want %s", c.query, got, c.want)
+			}
+		}
+
+		if w := serve("GET", "/trending.json?window=1y", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("window=1y: status %v, want %v", w.Code, http.StatusBadRequest)
+		}
+		if w := serve("GET", "/trending.html?window=30d", ""); w.Code != http.StatusOK ||
+			!strings.Contains(w.Body.String(), "/steady") {
+			t.Errorf("trending.html: status %v", w.Code)
+		}
+	})
+}
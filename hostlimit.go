@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxHostWait is the longest a worker will wait for its turn at a host. Links that would wait longer are left
+// for a later poll, so that one slow or busy host doesn't tie up the whole pool.
+const maxHostWait = 10 * time.Second
+
+// hostLimiter keeps the checker polite to each remote host: no more than perHost requests at once, and at least
+// delay between the start of one request and the next
+type hostLimiter struct {
+	perHost int
+	delay   time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	active int
+	next   time.Time // the earliest the next request may start
+	noHead bool      // the host doesn't support HEAD, so go straight to a GET
+}
+
+func newHostLimiter(perHost int, delay time.Duration) *hostLimiter {
+
+	return &hostLimiter{
+		perHost: perHost,
+		delay:   delay,
+		hosts:   make(map[string]*hostState),
+	}
+}
+
+// reserve books the next request to host, returning how long to wait before making it. It returns false if the
+// host already has as many requests going as it is allowed, or the wait would be longer than maxHostWait.
+// Every successful reserve must be followed by a done.
+func (l *hostLimiter) reserve(host string, now time.Time) (time.Duration, bool) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(host, now)
+	if h.active >= l.perHost {
+		return 0, false
+	}
+
+	start := now
+	if h.next.After(start) {
+		start = h.next
+	}
+	if start.Sub(now) > maxHostWait {
+		return 0, false
+	}
+	h.active++
+	h.next = start.Add(l.delay)
+
+	return start.Sub(now), true
+}
+
+// again books another request to a host the caller already has reserved, returning how long to wait before
+// making it. It returns false if the wait would be longer than maxHostWait.
+func (l *hostLimiter) again(host string, now time.Time) (time.Duration, bool) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(host, now)
+
+	start := now
+	if h.next.After(start) {
+		start = h.next
+	}
+	if start.Sub(now) > maxHostWait {
+		return 0, false
+	}
+	h.next = start.Add(l.delay)
+
+	return start.Sub(now), true
+}
+
+// follow books a request that follows on from one already made, such as the GET after a HEAD the host doesn't
+// support or a redirect, returning how long to wait before making it. As the check is under way it can't be
+// turned down, so it isn't counted against perHost and the wait is cut off at maxHostWait.
+func (l *hostLimiter) follow(host string, now time.Time) time.Duration {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(host, now)
+
+	start := now
+	if h.next.After(start) {
+		start = h.next
+	}
+	h.next = start.Add(l.delay)
+	if start.Sub(now) > maxHostWait {
+		return maxHostWait
+	}
+
+	return start.Sub(now)
+}
+
+func (l *hostLimiter) done(host string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.hosts[host]; ok && h.active > 0 {
+		h.active--
+	}
+}
+
+// noHead reports whether host is known not to support HEAD
+func (l *hostLimiter) noHead(host string) bool {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hosts[host]
+
+	return ok && h.noHead
+}
+
+func (l *hostLimiter) setNoHead(host string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.host(host, time.Now()).noHead = true
+}
+
+// host returns the state of a host, adding it if need be. Hosts that have nothing going and are past their delay
+// are cleared out now and then, unless they are known not to support HEAD, so the map doesn't grow forever.
+// The caller must hold mu.
+func (l *hostLimiter) host(host string, now time.Time) *hostState {
+
+	if len(l.hosts) > 10000 {
+		for k, h := range l.hosts {
+			if h.active == 0 && !h.noHead && now.After(h.next) {
+				delete(l.hosts, k)
+			}
+		}
+	}
+
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostState{}
+		l.hosts[host] = h
+	}
+
+	return h
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// redirect is one redirect read from an nginx, Apache or _redirects file, before it is checked as a link
+type redirect struct {
+	source    string // file:line
+	text      string
+	from      string // the path, with its leading slash
+	to        string
+	status    int
+	prefix    bool
+	passQuery bool
+}
+
+// importProblem is a line that couldn't be turned into a link, and why
+type importProblem struct {
+	source string
+	text   string
+	reason string
+}
+
+// redirectParsers read each of the formats that can be imported
+var redirectParsers = map[string]func(name string, r io.Reader) ([]redirect, []importProblem){
+	"nginx":     parseNginx,
+	"apache":    parseApache,
+	"redirects": parseRedirectsFile,
+}
+
+// importCommand reads redirects from nginx config, Apache config or .htaccess, or a Netlify style _redirects
+// file, and adds them as links. Lines that can't be translated are listed, and -dry-run shows what would change
+// without changing anything.
+func importCommand(args []string) int {
+
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "auto", "format of the files: nginx, apache, redirects or auto")
+	dryRun := fs.Bool("dry-run", false, "show the changes against the existing links, without making them")
+	update := fs.Bool("update", false, "change existing links, rather than leaving them as they are")
+	base := fs.String("base", "", "absolute url that relative destinations are resolved against")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: linkr import [-format f] [-dry-run] [-update] [-base url] file...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var baseURL *url.URL
+	if *base != "" {
+		u, err := url.Parse(*base)
+		if err != nil || validateLongUrl(*base) != nil {
+			fmt.Fprintln(os.Stderr, "-base must be an absolute http or https url")
+			return 2
+		}
+		baseURL = u
+	}
+
+	var redirects []redirect
+	var problems []importProblem
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fm := *format
+		if fm == "auto" {
+			fm = detectRedirectFormat(name, f)
+			if _, err = f.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		parse, ok := redirectParsers[fm]
+		if !ok {
+			f.Close()
+			fmt.Fprintf(os.Stderr, "%s: unknown format '%s'\n", name, fm)
+			return 2
+		}
+		rs, ps := parse(name, f)
+		f.Close()
+		redirects = append(redirects, rs...)
+		problems = append(problems, ps...)
+	}
+
+	links, ps := redirectLinks(redirects, baseURL)
+	problems = append(problems, ps...)
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n    %s\n", p.source, p.reason, p.text)
+	}
+	if len(problems) > 0 {
+		fmt.Println()
+	}
+
+	added, changed, unchanged, skipped, failed := 0, 0, 0, 0, 0
+	for _, il := range links {
+		old, err := Store.FindLink(il.ShortUrl)
+		if err != nil && err != ErrNotFound {
+			fmt.Fprintf(os.Stderr, "%s: error finding link /%s: %s\n", il.source, il.ShortUrl, err)
+			return 1
+		}
+
+		if err == ErrNotFound {
+			fmt.Printf("+ /%s -> %s\n", il.ShortUrl, describeRedirect(il.LinkDoc))
+			added++
+			if !*dryRun {
+				if err = Store.AddLink(il.LinkDoc); err != nil {
+					fmt.Printf("  %s: error adding link: %s\n", il.source, err)
+					failed++
+				}
+			}
+			continue
+		}
+
+		ld := old
+		ld.LongUrl, ld.RedirectType, ld.Prefix, ld.PassQuery = il.LongUrl, il.RedirectType, il.Prefix, il.PassQuery
+		if describeRedirect(ld) == describeRedirect(old) {
+			unchanged++
+			continue
+		}
+		if !*update {
+			fmt.Printf("! /%s already exists: %s, not %s\n", old.ShortUrl, describeRedirect(old), describeRedirect(ld))
+			skipped++
+			continue
+		}
+
+		fmt.Printf("~ /%s: %s -> %s\n", old.ShortUrl, describeRedirect(old), describeRedirect(ld))
+		changed++
+		if *dryRun {
+			continue
+		}
+		// New target so the old status no longer applies, as for an update through the API
+		if ld.LongUrl != old.LongUrl {
+			resetCheckState(&ld)
+		}
+		ld.UpdatedAt = time.Now()
+		if _, err = Store.UpdateLink(old.ShortUrl, ld); err != nil {
+			fmt.Printf("  %s: error updating link: %s\n", il.source, err)
+			failed++
+		}
+	}
+
+	verb := "added"
+	if *dryRun {
+		verb = "to add"
+	}
+	fmt.Printf("\n%d %s, %d changed, %d unchanged, %d existing left alone, %d lines not translated",
+		added, verb, changed, unchanged, skipped, len(problems))
+	if failed > 0 {
+		fmt.Printf(", %d failed", failed)
+	}
+	fmt.Println()
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// importedLink is a link made from a redirect, with the line it came from
+type importedLink struct {
+	LinkDoc
+	source string
+}
+
+// redirectLinks turns redirects into links, checking them as the API would. Where two redirects are for the same
+// path the first is kept, as nginx, Apache and Netlify all use the first match.
+func redirectLinks(redirects []redirect, base *url.URL) ([]importedLink, []importProblem) {
+
+	var links []importedLink
+	var problems []importProblem
+	seen := make(map[string]string)
+	now := time.Now()
+
+	for _, rd := range redirects {
+		problem := func(reason string) {
+			problems = append(problems, importProblem{rd.source, rd.text, reason})
+		}
+
+		to := rd.to
+		if validateLongUrl(to) != nil {
+			u, err := url.Parse(to)
+			if base == nil || err != nil || !strings.HasPrefix(to, "/") {
+				problem("destination is not an absolute url, use -base for relative ones")
+				continue
+			}
+			to = base.ResolveReference(u).String()
+		}
+
+		if !validRedirectTypes[rd.status] {
+			problem(fmt.Sprintf("status %d is not a redirect", rd.status))
+			continue
+		}
+
+		ld := LinkDoc{
+			ID:           bson.NewObjectId(),
+			CreatedAt:    now,
+			UpdatedAt:    now,
+			ShortUrl:     strings.Trim(rd.from, "/"),
+			LongUrl:      to,
+			Active:       true,
+			RedirectType: rd.status,
+			Prefix:       rd.prefix,
+			PassQuery:    rd.passQuery && !rd.prefix,
+		}
+		if ld.ShortUrl == "" {
+			problem("redirects the home page, which linkr keeps for its own")
+			continue
+		}
+		if err := setNamespace(&ld); err != nil {
+			problem(err.Error())
+			continue
+		}
+		if err := validateLink(ld); err != nil {
+			problem(err.Error())
+			continue
+		}
+		if first, ok := seen[ld.ShortUrl]; ok {
+			problem("path already redirected at " + first)
+			continue
+		}
+		seen[ld.ShortUrl] = rd.source
+
+		links = append(links, importedLink{ld, rd.source})
+	}
+
+	return links, problems
+}
+
+// describeRedirect sums up where a link goes, for the import report
+func describeRedirect(ld LinkDoc) string {
+
+	s := fmt.Sprintf("%s (%d", ld.LongUrl, redirectType(ld))
+	if ld.Prefix {
+		s += ", prefix"
+	}
+	if ld.PassQuery {
+		s += ", passQuery"
+	}
+
+	return s + ")"
+}
+
+// detectRedirectFormat guesses the format from the file name, or the first directive in it
+func detectRedirectFormat(name string, r io.Reader) string {
+
+	switch filepath.Base(name) {
+	case "_redirects":
+		return "redirects"
+	case ".htaccess":
+		return "apache"
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(stripComment(s.Text()))
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToLower(f[0]) {
+		case "rewrite", "return", "location", "server", "server_name", "listen":
+			return "nginx"
+		case "redirect", "redirectmatch", "redirectpermanent", "redirecttemp", "rewriterule", "rewritecond",
+			"rewriteengine", "<virtualhost", "<ifmodule", "<directory":
+			return "apache"
+		}
+		if strings.HasPrefix(f[0], "/") {
+			return "redirects"
+		}
+	}
+
+	return "redirects"
+}
+
+// stripComment removes a # comment from a line, unless the # is in quotes
+func stripComment(line string) string {
+
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// splitFields splits a directive on spaces, keeping quoted strings together without their quotes
+func splitFields(s string) []string {
+
+	var fields []string
+	var b bytes.Buffer
+	var quote rune
+	inField := false
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				b.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inField = c, true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		default:
+			b.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+
+	return fields
+}
+
+// literalPath turns a regex that only matches one path back into the path, eg ^/old/?$. A regex for a path and
+// everything under it, eg ^/docs/(.*)$, gives the path and prefix true. Anything else needs a rule instead.
+func literalPath(pattern string) (path string, prefix bool, ok bool) {
+
+	if !strings.HasPrefix(pattern, "^") {
+		return "", false, false
+	}
+	p := strings.TrimPrefix(pattern, "^")
+	anchored := strings.HasSuffix(p, "$") && !strings.HasSuffix(p, `\$`)
+	p = strings.TrimSuffix(p, "$")
+
+	if strings.HasSuffix(p, "/(.*)") {
+		p, prefix = strings.TrimSuffix(p, "/(.*)"), true
+	} else if !anchored {
+		return "", false, false
+	}
+	p = strings.TrimSuffix(p, "/?")
+
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '\\':
+			i++
+			if i == len(p) || isAlnum(p[i]) {
+				return "", false, false
+			}
+			b.WriteByte(p[i])
+		case strings.IndexByte("*+?()[]{}|^$", c) >= 0:
+			return "", false, false
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	path = b.String()
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path, prefix, true
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// regexRedirect makes a redirect from a pattern and a replacement, as in nginx rewrite, Apache RedirectMatch and
+// RewriteRule, if the pattern is for one path or a prefix whose rest is put on the end of the replacement.
+func regexRedirect(rd redirect, pattern, replacement string) (redirect, string) {
+
+	path, prefix, ok := literalPath(pattern)
+	if !ok {
+		return rd, "pattern matches more than one path, add it as a rule instead"
+	}
+	if prefix {
+		if !strings.HasSuffix(replacement, "$1") {
+			return rd, "every path under the pattern goes to the same url, which a prefix link can't do"
+		}
+		replacement = strings.TrimSuffix(replacement, "$1")
+	}
+	if strings.Contains(replacement, "$") {
+		return rd, "replacement uses variables or groups"
+	}
+
+	rd.from, rd.to, rd.prefix = path, replacement, prefix
+
+	return rd, ""
+}
+
+// parseNginx reads rewrite and return directives from nginx config. A return is translated inside an exact or
+// regex location, or a prefix location if it ends in $request_uri. Directives inside an if are reported, as are
+// rewrites that aren't redirects.
+func parseNginx(name string, r io.Reader) ([]redirect, []importProblem) {
+
+	var redirects []redirect
+	var problems []importProblem
+
+	// Each statement ends in ; and a block header in {, so directives can run over several lines
+	var blocks []string
+	var stmt bytes.Buffer
+	stmtLine := 0
+
+	handle := func(line int, text string) {
+		source := fmt.Sprintf("%s:%d", name, line)
+		f := splitFields(text)
+		if len(f) == 0 {
+			return
+		}
+		rd := redirect{source: source, text: text}
+		problem := func(reason string) {
+			problems = append(problems, importProblem{source, text, reason})
+		}
+
+		var location string
+		for _, b := range blocks {
+			bf := splitFields(b)
+			if len(bf) > 0 && bf[0] == "if" {
+				if f[0] == "rewrite" || f[0] == "return" {
+					problem("redirect depends on an if condition")
+				}
+				return
+			}
+			if len(bf) > 0 && bf[0] == "location" {
+				location = b
+			}
+		}
+
+		switch f[0] {
+		case "rewrite":
+			if len(f) < 3 {
+				problem("rewrite needs a pattern and a replacement")
+				return
+			}
+			replacement := f[2]
+			flag := ""
+			if len(f) > 3 {
+				flag = f[3]
+			}
+			switch {
+			case flag == "permanent":
+				rd.status = 301
+			case flag == "redirect":
+				rd.status = 302
+			case flag == "" && (strings.HasPrefix(replacement, "http://") || strings.HasPrefix(replacement, "https://")):
+				rd.status = 302
+			default:
+				problem("rewrite is internal, not a redirect")
+				return
+			}
+			// The query string goes on the end unless the replacement ends in ?
+			rd.passQuery = !strings.HasSuffix(replacement, "?")
+			replacement = strings.TrimSuffix(replacement, "?")
+
+			var reason string
+			rd, reason = regexRedirect(rd, f[1], replacement)
+			if reason != "" {
+				problem(reason)
+				return
+			}
+
+		case "return":
+			if len(f) < 3 {
+				if len(f) == 2 && (f[1] == "301" || f[1] == "302" || f[1] == "303" || f[1] == "307" || f[1] == "308") {
+					problem("return has no url")
+				} else {
+					problem("return is not a redirect")
+				}
+				return
+			}
+			rd.status, _ = strconv.Atoi(f[1])
+			to := f[2]
+
+			lf := splitFields(location)
+			if len(lf) < 2 {
+				problem("return applies to the whole server")
+				return
+			}
+			if (lf[1] == "=" || lf[1] == "~" || lf[1] == "~*") && len(lf) < 3 {
+				problem("location has no path")
+				return
+			}
+			switch lf[1] {
+			case "=":
+				rd.from = lf[2]
+			case "~", "~*":
+				path, prefix, ok := literalPath(lf[2])
+				if !ok || prefix {
+					problem("location matches more than one path, add it as a rule instead")
+					return
+				}
+				rd.from = path
+			default:
+				if strings.HasPrefix(lf[1], "^~") || !strings.HasPrefix(lf[1], "/") {
+					problem("location is not one that can be translated")
+					return
+				}
+				rd.from, rd.prefix = lf[1], true
+				if !strings.HasSuffix(to, "$request_uri") {
+					problem("every path under the location goes to the same url, which a prefix link can't do")
+					return
+				}
+			}
+
+			// $request_uri is the whole path and query, $is_args$args just the query
+			switch {
+			case strings.HasSuffix(to, "$request_uri"):
+				to = strings.TrimSuffix(strings.TrimSuffix(to, "$request_uri"), "/") + "/" + strings.Trim(rd.from, "/")
+				rd.passQuery = true
+			case strings.HasSuffix(to, "$is_args$args"):
+				to = strings.TrimSuffix(to, "$is_args$args")
+				rd.passQuery = true
+			}
+			if strings.Contains(to, "$") {
+				problem("url uses variables")
+				return
+			}
+			rd.to = to
+
+		default:
+			return
+		}
+
+		redirects = append(redirects, rd)
+	}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		for _, c := range stripComment(s.Text()) {
+			if stmt.Len() == 0 {
+				if c == ' ' || c == '\t' {
+					continue
+				}
+				stmtLine = n
+			}
+			switch c {
+			case ';':
+				handle(stmtLine, strings.TrimSpace(stmt.String()))
+				stmt.Reset()
+			case '{':
+				blocks = append(blocks, strings.TrimSpace(stmt.String()))
+				stmt.Reset()
+			case '}':
+				if len(blocks) > 0 {
+					blocks = blocks[:len(blocks)-1]
+				}
+				stmt.Reset()
+			default:
+				stmt.WriteRune(c)
+			}
+		}
+		if stmt.Len() > 0 {
+			stmt.WriteByte(' ')
+		}
+	}
+
+	return redirects, problems
+}
+
+// apacheStatus is the status of a Redirect or RedirectMatch, as a keyword or a number
+func apacheStatus(s string) (int, bool) {
+
+	switch strings.ToLower(s) {
+	case "permanent":
+		return 301, true
+	case "temp":
+		return 302, true
+	case "seeother":
+		return 303, true
+	case "gone":
+		return 410, true
+	}
+	n, err := strconv.Atoi(s)
+
+	return n, err == nil
+}
+
+// apacheConditional are the sections whose directives only apply to some requests
+var apacheConditional = map[string]bool{
+	"location": true, "locationmatch": true, "if": true, "elseif": true, "else": true, "files": true,
+	"filesmatch": true,
+}
+
+// parseApache reads Redirect, RedirectMatch, RedirectPermanent, RedirectTemp and RewriteRule lines from Apache
+// config or .htaccess. Redirect covers everything under its path, so it becomes a prefix link. A RewriteRule
+// is translated if it redirects, and reported if it has RewriteCond conditions.
+func parseApache(name string, r io.Reader) ([]redirect, []importProblem) {
+
+	var redirects []redirect
+	var problems []importProblem
+	var sections []string
+	conditions := false
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimSpace(stripComment(s.Text()))
+		if text == "" {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", name, n)
+		problem := func(reason string) {
+			problems = append(problems, importProblem{source, text, reason})
+		}
+
+		if strings.HasPrefix(text, "</") {
+			if len(sections) > 0 {
+				sections = sections[:len(sections)-1]
+			}
+			continue
+		}
+		if strings.HasPrefix(text, "<") {
+			section := strings.ToLower(strings.TrimRight(strings.Fields(text)[0][1:], ">"))
+			sections = append(sections, section)
+			continue
+		}
+
+		f := splitFields(text)
+		directive := strings.ToLower(f[0])
+		rd := redirect{source: source, text: text}
+
+		switch directive {
+		case "redirect", "redirectmatch", "redirectpermanent", "redirecttemp", "rewriterule":
+		case "rewritecond":
+			conditions = true
+			continue
+		default:
+			continue
+		}
+		hasConditions := conditions
+		if directive == "rewriterule" {
+			conditions = false
+		}
+
+		conditional := false
+		for _, sec := range sections {
+			conditional = conditional || apacheConditional[sec]
+		}
+		if conditional {
+			problem("redirect is inside a section that only applies to some requests")
+			continue
+		}
+
+		switch directive {
+		case "redirect", "redirectmatch":
+			args := f[1:]
+			rd.status = 302
+			if len(args) > 0 {
+				if status, ok := apacheStatus(args[0]); ok {
+					rd.status, args = status, args[1:]
+				}
+			}
+			if !validRedirectTypes[rd.status] {
+				problem(fmt.Sprintf("status %d is not a redirect", rd.status))
+				continue
+			}
+			if len(args) != 2 {
+				problem(f[0] + " needs a path and a url")
+				continue
+			}
+			// The query string is passed on unless the url has its own
+			rd.passQuery = !strings.Contains(args[1], "?")
+			if directive == "redirect" {
+				rd.from, rd.to, rd.prefix = args[0], args[1], true
+			} else {
+				var reason string
+				rd, reason = regexRedirect(rd, args[0], args[1])
+				if reason != "" {
+					problem(reason)
+					continue
+				}
+			}
+
+		case "redirectpermanent", "redirecttemp":
+			if len(f) != 3 {
+				problem(f[0] + " needs a path and a url")
+				continue
+			}
+			rd.status = 301
+			if directive == "redirecttemp" {
+				rd.status = 302
+			}
+			rd.from, rd.to, rd.prefix = f[1], f[2], true
+			rd.passQuery = !strings.Contains(f[2], "?")
+
+		case "rewriterule":
+			if hasConditions {
+				problem("rule depends on RewriteCond conditions")
+				continue
+			}
+			if len(f) < 3 {
+				problem("RewriteRule needs a pattern and a substitution")
+				continue
+			}
+			flags := map[string]string{}
+			if len(f) > 3 {
+				for _, fl := range strings.Split(strings.Trim(f[3], "[]"), ",") {
+					kv := strings.SplitN(fl, "=", 2)
+					v := ""
+					if len(kv) == 2 {
+						v = kv[1]
+					}
+					flags[strings.ToUpper(strings.TrimSpace(kv[0]))] = v
+				}
+			}
+			sub := f[2]
+			absolute := strings.HasPrefix(sub, "http://") || strings.HasPrefix(sub, "https://")
+			status, isRedirect := flags["R"]
+			if !isRedirect {
+				status, isRedirect = flags["REDIRECT"]
+			}
+			if !isRedirect && !absolute {
+				problem("rule is internal, not a redirect")
+				continue
+			}
+			rd.status = 302
+			if status != "" {
+				code, ok := apacheStatus(status)
+				if !ok {
+					problem("unknown status " + status)
+					continue
+				}
+				rd.status = code
+			}
+			// The query string is passed on unless the substitution has its own, or QSD drops it
+			_, qsa := flags["QSA"]
+			_, qsd := flags["QSD"]
+			rd.passQuery = !qsd && (qsa || !strings.Contains(sub, "?"))
+			sub = strings.TrimSuffix(sub, "?")
+
+			// In .htaccess the pattern is matched without the leading slash, so it is often written ^/? to work in both
+			pattern := f[1]
+			if strings.HasPrefix(pattern, "^") {
+				pattern = "^/" + strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(pattern, "^"), "/?"), "/")
+			}
+			var reason string
+			rd, reason = regexRedirect(rd, pattern, sub)
+			if reason != "" {
+				problem(reason)
+				continue
+			}
+		}
+
+		redirects = append(redirects, rd)
+	}
+
+	return redirects, problems
+}
+
+// parseRedirectsFile reads a Netlify style _redirects file, with lines such as `/old /new 301`. A path ending in
+// /* becomes a prefix link if the destination ends in :splat. Lines with placeholders, conditions or a status that
+// isn't a redirect are reported.
+func parseRedirectsFile(name string, r io.Reader) ([]redirect, []importProblem) {
+
+	var redirects []redirect
+	var problems []importProblem
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimSpace(stripComment(s.Text()))
+		if text == "" {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", name, n)
+		problem := func(reason string) {
+			problems = append(problems, importProblem{source, text, reason})
+		}
+
+		f := strings.Fields(text)
+		if len(f) < 2 {
+			problem("line needs a path and a destination")
+			continue
+		}
+		rd := redirect{source: source, text: text, from: f[0], to: f[1], status: 301, passQuery: true}
+
+		// Anything after the status is a condition, eg Country=nz
+		rest := f[2:]
+		if len(rest) > 0 && !strings.Contains(rest[0], "=") {
+			status, err := strconv.Atoi(strings.TrimSuffix(rest[0], "!"))
+			if err != nil {
+				problem("unknown status " + rest[0])
+				continue
+			}
+			rd.status, rest = status, rest[1:]
+		}
+		if !validRedirectTypes[rd.status] {
+			problem(fmt.Sprintf("status %d is not a redirect", rd.status))
+			continue
+		}
+		if len(rest) > 0 {
+			problem("redirect has conditions")
+			continue
+		}
+		if strings.Contains(f[0], "=") || strings.Contains(f[0], "?") {
+			problem("redirect depends on the query string")
+			continue
+		}
+
+		if strings.HasSuffix(rd.from, "/*") {
+			if !strings.HasSuffix(rd.to, ":splat") {
+				problem("every path under the path goes to the same url, which a prefix link can't do")
+				continue
+			}
+			rd.from, rd.prefix = strings.TrimSuffix(rd.from, "/*"), true
+			rd.to = strings.TrimSuffix(rd.to, ":splat")
+		}
+		if strings.ContainsAny(rd.from, ":*") || strings.Contains(rd.to, "/:") {
+			problem("redirect uses placeholders")
+			continue
+		}
+
+		redirects = append(redirects, rd)
+	}
+
+	return redirects, problems
+}
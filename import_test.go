@@ -0,0 +1,270 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// importCase is a config file and what should be read from it, the redirects without their text
+type importCase struct {
+	name     string
+	config   string
+	want     []redirect
+	problems []string
+}
+
+// testParser runs parse on each case, as the file "t"
+func testParser(t *testing.T, parse func(name string, r io.Reader) ([]redirect, []importProblem), cases []importCase) {
+
+	for _, c := range cases {
+		rs, ps := parse("t", strings.NewReader(c.config))
+		for i := range rs {
+			rs[i].text = ""
+		}
+		if !reflect.DeepEqual(rs, c.want) {
+			t.Errorf("%s: redirects\n got %+v\nwant %+v", c.name, rs, c.want)
+		}
+		var reasons []string
+		for _, p := range ps {
+			reasons = append(reasons, p.reason)
+		}
+		if !reflect.DeepEqual(reasons, c.problems) {
+			t.Errorf("%s: problems %q, want %q", c.name, reasons, c.problems)
+		}
+	}
+}
+
+func TestParseNginx(t *testing.T) {
+
+	testParser(t, parseNginx, []importCase{
+		{
+			name:   "permanent rewrite",
+			config: "rewrite ^/old/?$ https://example.org/new permanent;",
+			want:   []redirect{{source: "t:1", from: "/old", to: "https://example.org/new", status: 301, passQuery: true}},
+		},
+		{
+			name:   "prefix rewrite",
+			config: "server {\n  rewrite ^/docs/(.*)$ https://example.org/d/$1 redirect;\n}",
+			want: []redirect{{source: "t:2", from: "/docs", to: "https://example.org/d/", status: 302, prefix: true,
+				passQuery: true}},
+		},
+		{
+			name:   "absolute rewrite without a flag, dropping the query",
+			config: "rewrite ^/a$\n    https://example.org/a?;",
+			want:   []redirect{{source: "t:1", from: "/a", to: "https://example.org/a", status: 302}},
+		},
+		{
+			name:     "internal rewrite",
+			config:   "rewrite ^/a$ /b last;",
+			problems: []string{"rewrite is internal, not a redirect"},
+		},
+		{
+			name:     "rewrite of many paths",
+			config:   `rewrite ^/p/(\d+)$ https://example.org/$1 permanent;`,
+			problems: []string{"pattern matches more than one path, add it as a rule instead"},
+		},
+		{
+			name:   "return in an exact location",
+			config: "location = /about.html {\n  return 301 https://example.org/about;\n}",
+			want:   []redirect{{source: "t:2", from: "/about.html", to: "https://example.org/about", status: 301}},
+		},
+		{
+			name:   "return in a prefix location",
+			config: "location /blog/ { return 308 https://blog.example.org$request_uri; }",
+			want: []redirect{{source: "t:1", from: "/blog/", to: "https://blog.example.org/blog", status: 308, prefix: true,
+				passQuery: true}},
+		},
+		{
+			name:     "prefix location to one url",
+			config:   "location /blog/ { return 301 https://blog.example.org; }",
+			problems: []string{"every path under the location goes to the same url, which a prefix link can't do"},
+		},
+		{
+			name:     "return inside an if",
+			config:   "if ($host = old.example.org) { return 301 https://example.org; }",
+			problems: []string{"redirect depends on an if condition"},
+		},
+		{
+			name:     "return for the whole server",
+			config:   "server { return 301 https://example.org$request_uri; }",
+			problems: []string{"return applies to the whole server"},
+		},
+		{
+			name:     "return that isn't a redirect",
+			config:   "location = /x { return 404; }",
+			problems: []string{"return is not a redirect"},
+		},
+	})
+}
+
+func TestParseApache(t *testing.T) {
+
+	testParser(t, parseApache, []importCase{
+		{
+			name:   "Redirect",
+			config: "Redirect 301 /old https://example.org/new",
+			want: []redirect{{source: "t:1", from: "/old", to: "https://example.org/new", status: 301, prefix: true,
+				passQuery: true}},
+		},
+		{
+			name:   "Redirect with its own query",
+			config: "# moved\nRedirect /old.html https://example.org/new?x=1",
+			want:   []redirect{{source: "t:2", from: "/old.html", to: "https://example.org/new?x=1", status: 302, prefix: true}},
+		},
+		{
+			name:   "RedirectMatch",
+			config: "RedirectMatch permanent ^/a/?$ https://example.org/a",
+			want:   []redirect{{source: "t:1", from: "/a", to: "https://example.org/a", status: 301, passQuery: true}},
+		},
+		{
+			name:   "RewriteRule from .htaccess",
+			config: "RewriteEngine On\nRewriteRule ^old$ https://example.org/new [R=301,L]",
+			want:   []redirect{{source: "t:2", from: "/old", to: "https://example.org/new", status: 301, passQuery: true}},
+		},
+		{
+			name:   "prefix RewriteRule dropping the query",
+			config: "RewriteRule ^/?docs/(.*)$ https://example.org/docs/$1 [R=302,QSD]",
+			want:   []redirect{{source: "t:1", from: "/docs", to: "https://example.org/docs/", status: 302, prefix: true}},
+		},
+		{
+			name:     "internal RewriteRule",
+			config:   "RewriteRule ^internal$ /other [L]",
+			problems: []string{"rule is internal, not a redirect"},
+		},
+		{
+			name:     "RewriteRule with conditions",
+			config:   "RewriteCond %{HTTP_HOST} ^old\\.example\\.org$\nRewriteRule ^a$ https://example.org/a [R=301]",
+			problems: []string{"rule depends on RewriteCond conditions"},
+		},
+		{
+			name:     "Redirect in a Location",
+			config:   "<Location /x>\n  Redirect /x https://example.org\n</Location>",
+			problems: []string{"redirect is inside a section that only applies to some requests"},
+		},
+		{
+			name:   "Redirect in a VirtualHost",
+			config: "<VirtualHost *:80>\n  RedirectPermanent /x https://example.org/x\n</VirtualHost>",
+			want: []redirect{{source: "t:2", from: "/x", to: "https://example.org/x", status: 301, prefix: true,
+				passQuery: true}},
+		},
+		{
+			name:     "gone",
+			config:   "Redirect gone /old",
+			problems: []string{"status 410 is not a redirect"},
+		},
+	})
+}
+
+func TestParseRedirectsFile(t *testing.T) {
+
+	testParser(t, parseRedirectsFile, []importCase{
+		{
+			name:   "redirect",
+			config: "/old https://example.org/new 301",
+			want:   []redirect{{source: "t:1", from: "/old", to: "https://example.org/new", status: 301, passQuery: true}},
+		},
+		{
+			name:   "forced, with the default status before it",
+			config: "/a https://example.org/a\n\n/b https://example.org/b 302!",
+			want: []redirect{
+				{source: "t:1", from: "/a", to: "https://example.org/a", status: 301, passQuery: true},
+				{source: "t:3", from: "/b", to: "https://example.org/b", status: 302, passQuery: true},
+			},
+		},
+		{
+			name:   "splat",
+			config: "/docs/* https://example.org/docs/:splat",
+			want: []redirect{{source: "t:1", from: "/docs", to: "https://example.org/docs/", status: 301, prefix: true,
+				passQuery: true}},
+		},
+		{
+			name:     "splat to one url",
+			config:   "/blog/* https://example.org/blog",
+			problems: []string{"every path under the path goes to the same url, which a prefix link can't do"},
+		},
+		{
+			name:     "rewrite",
+			config:   "/* /index.html 200",
+			problems: []string{"status 200 is not a redirect"},
+		},
+		{
+			name:     "placeholder",
+			config:   "/news/:year https://example.org/news/:year",
+			problems: []string{"redirect uses placeholders"},
+		},
+		{
+			name:     "condition",
+			config:   "/ca https://example.org/ca 302 Country=ca",
+			problems: []string{"redirect has conditions"},
+		},
+		{
+			name:     "no destination",
+			config:   "/only",
+			problems: []string{"line needs a path and a destination"},
+		},
+	})
+}
+
+func TestDetectRedirectFormat(t *testing.T) {
+
+	for _, c := range []struct {
+		name, config, want string
+	}{
+		{"_redirects", "rewrite ^/a$ /b;", "redirects"},
+		{"site/.htaccess", "", "apache"},
+		{"old-site", "# old site\nserver {\n  listen 80;\n}", "nginx"},
+		{"apache.conf", "<VirtualHost *:80>", "apache"},
+		{"moved.txt", "/old /new", "redirects"},
+	} {
+		got := detectRedirectFormat(c.name, strings.NewReader(c.config))
+		if got != c.want {
+			t.Errorf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRedirectLinks(t *testing.T) {
+
+	base, _ := url.Parse("https://example.org")
+	redirects := []redirect{
+		{source: "t:1", from: "/about.html", to: "https://example.org/about", status: 301},
+		{source: "t:2", from: "/old/page", to: "/new/page", status: 302},
+		{source: "t:3", from: "/docs/", to: "https://example.org/d/", status: 301, prefix: true, passQuery: true},
+		{source: "t:4", from: "/about.html", to: "https://example.org/other", status: 301},
+		{source: "t:5", from: "/", to: "https://example.org", status: 301},
+		{source: "t:6", from: "/feed.json", to: "https://example.org/feed", status: 301},
+		{source: "t:7", from: "/a b", to: "https://example.org/ab", status: 301},
+	}
+
+	links, problems := redirectLinks(redirects, base)
+
+	var got []string
+	for _, l := range links {
+		got = append(got, l.ShortUrl+" "+describeRedirect(l.LinkDoc))
+	}
+	want := []string{
+		"about.html https://example.org/about (301)",
+		"old/page https://example.org/new/page (302)",
+		"docs https://example.org/d/ (301, prefix)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("links\n got %q\nwant %q", got, want)
+	}
+
+	var sources []string
+	for _, p := range problems {
+		sources = append(sources, p.source)
+	}
+	if !reflect.DeepEqual(sources, []string{"t:4", "t:5", "t:6", "t:7"}) {
+		t.Errorf("problems %+v, want t:4 to t:7", problems)
+	}
+
+	// Without a base a relative destination can't be translated
+	_, problems = redirectLinks(redirects[1:2], nil)
+	if len(problems) != 1 {
+		t.Errorf("relative destination without -base: %+v", problems)
+	}
+}
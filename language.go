@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LanguageURLs maps language tags, eg en or es-MX, to the url for that language. An update replaces the whole map,
+// as clearReplacedFields does for every map and slice, so languages can be removed.
+type LanguageURLs map[string]string
+
+// languageRange is one entry of an Accept-Language header
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// languageAliases are deprecated language subtags that browsers and older pages still send, and what replaced them
+var languageAliases = map[string]string{"iw": "he", "in": "id", "ji": "yi", "jw": "jv", "mo": "ro"}
+
+// regionScripts are the scripts implied by the regions of Chinese tags without one, as zh-TW is written in
+// traditional characters and zh-CN in simplified ones
+var regionScripts = map[string]string{"zh-tw": "hant", "zh-hk": "hant", "zh-mo": "hant", "zh-cn": "hans", "zh-sg": "hans"}
+
+// validLanguageTag is the general shape of a BCP 47 tag, which is as much as matching needs
+var validLanguageTag = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// parseAcceptLanguage returns the ranges in an Accept-Language header, most preferred first
+func parseAcceptLanguage(h string) []languageRange {
+
+	var rs []languageRange
+	for _, part := range strings.Split(h, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		lr := languageRange{tag: tag, q: 1}
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				lr.q = q
+			}
+		}
+		rs = append(rs, lr)
+	}
+
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].q > rs[j].q })
+
+	return rs
+}
+
+// matchLanguage picks the tag from available that best suits the Accept-Language header, by the lookup scheme of
+// RFC 4647. Each range, in order of preference, is tried as is and then with subtags removed from the end, so es-MX
+// can be served by es. Unlike lookup a range also matches a more specific tag, so es can be served by es-ES, but not
+// one in another script than the header asks for elsewhere, so zh-TW, zh isn't served by zh-Hans. Deprecated
+// language subtags such as iw match their replacements, and languages given q=0 are never chosen. It is not the
+// full BCP 47 matching of likely subtags and distances, and returns "" when nothing matches.
+func matchLanguage(header string, available []string) string {
+
+	ranges := parseAcceptLanguage(header)
+
+	// Tags ruled out by q=0, and the script each language is wanted in, from the first range to say or imply one
+	excluded := make(map[string]bool)
+	scripts := make(map[string]string)
+	for i, r := range ranges {
+		r.tag = canonicalLanguageTag(r.tag)
+		ranges[i] = r
+		if r.q == 0 {
+			excluded[r.tag] = true
+		} else if s := languageScript(r.tag); s != "" && scripts[primaryLanguage(r.tag)] == "" {
+			scripts[primaryLanguage(r.tag)] = s
+		}
+	}
+
+	// The rest in a fixed order so that the result doesn't depend on map order
+	tags := make(map[string]string)
+	var keys []string
+	for _, a := range available {
+		t := canonicalLanguageTag(a)
+		if !excluded[t] {
+			tags[t] = a
+			keys = append(keys, t)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, r := range ranges {
+		if r.q == 0 || r.tag == "*" {
+			continue
+		}
+
+		// Exact, or with subtags truncated
+		for t := r.tag; t != ""; t = truncateLanguageTag(t) {
+			if a, ok := tags[t]; ok {
+				return a
+			}
+		}
+
+		// A more specific version of the range, in the script wanted
+		want := scripts[primaryLanguage(r.tag)]
+		for _, k := range keys {
+			if s := languageScript(k); strings.HasPrefix(k, r.tag+"-") && (want == "" || s == "" || s == want) {
+				return tags[k]
+			}
+		}
+	}
+
+	return ""
+}
+
+// canonicalLanguageTag lower cases a tag and replaces a deprecated language subtag, so iw-IL becomes he-il
+func canonicalLanguageTag(t string) string {
+
+	t = strings.ToLower(t)
+	lang := primaryLanguage(t)
+	if a, ok := languageAliases[lang]; ok {
+		t = a + t[len(lang):]
+	}
+
+	return t
+}
+
+// primaryLanguage is the language subtag that a tag starts with
+func primaryLanguage(t string) string {
+
+	if i := strings.Index(t, "-"); i >= 0 {
+		return t[:i]
+	}
+
+	return t
+}
+
+// languageScript is the script subtag of a lower case tag, or the script its region implies, or "" if neither
+func languageScript(t string) string {
+
+	parts := strings.Split(t, "-")
+	if len(parts) < 2 {
+		return ""
+	}
+	if len(parts[1]) == 4 {
+		return parts[1]
+	}
+
+	return regionScripts[parts[0]+"-"+parts[1]]
+}
+
+// truncateLanguageTag removes the last subtag, along with a single letter one such as an extension
+// singleton that would be left dangling
+func truncateLanguageTag(t string) string {
+
+	i := strings.LastIndex(t, "-")
+	if i < 0 {
+		return ""
+	}
+	t = t[:i]
+	if i = strings.LastIndex(t, "-"); i >= 0 && len(t)-i == 2 {
+		t = t[:i]
+	}
+
+	return t
+}
+
+// validateLanguages checks each language is a plausible tag with a usable url
+func validateLanguages(l LanguageURLs) error {
+
+	seen := make(map[string]bool)
+	for tag, u := range l {
+		if !validLanguageTag.MatchString(tag) {
+			return fmt.Errorf("languages[%s] is not a language tag, eg en or es-MX", tag)
+		}
+		if seen[strings.ToLower(tag)] {
+			return fmt.Errorf("languages[%s] is given more than once", tag)
+		}
+		seen[strings.ToLower(tag)] = true
+		err := validateLongUrl(u)
+		if err != nil {
+			return fmt.Errorf("languages[%s] url: %s", tag, err)
+		}
+	}
+
+	return nil
+}
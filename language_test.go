@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+
+	got := parseAcceptLanguage("da, en-GB;q=0.8, en;q=0.7, fr;q=bad, *;q=0.1")
+	want := []languageRange{{"da", 1}, {"en-gb", 0.8}, {"en", 0.7}, {"*", 0.1}, {"fr", 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTruncateLanguageTag(t *testing.T) {
+
+	// The lookup fallback in RFC 4647 section 3.4, which drops the x singleton along with private1
+	var got []string
+	for tag := "zh-hant-cn-x-private1-private2"; tag != ""; tag = truncateLanguageTag(tag) {
+		got = append(got, tag)
+	}
+	want := []string{"zh-hant-cn-x-private1-private2", "zh-hant-cn-x-private1", "zh-hant-cn", "zh-hant", "zh"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMatchLanguage(t *testing.T) {
+
+	for _, c := range []struct {
+		header    string
+		available []string
+		want      string
+	}{
+		{"es-MX,es;q=0.9,en;q=0.8", []string{"en", "es"}, "es"},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"de", "en"}, "en"},
+		{"en;q=0.5, de", []string{"en", "de"}, "de"},
+		{"EN-us", []string{"en-US"}, "en-US"},
+		{"es", []string{"en", "es-ES"}, "es-ES"},
+		{"es", []string{"es-MX", "es-AR"}, "es-AR"},
+		{"es-MX", []string{"es-AR", "es"}, "es"},
+		{"pt-BR", []string{"pt-PT"}, ""},
+		{"zh-Hant-TW", []string{"zh", "zh-Hant"}, "zh-Hant"},
+
+		// Not a more specific tag in another script
+		{"zh-TW, zh;q=0.9", []string{"zh-Hans", "en"}, ""},
+		{"zh-TW, zh;q=0.9", []string{"zh-Hans", "zh-Hant"}, "zh-Hant"},
+		{"zh-Hant, zh;q=0.9", []string{"zh-CN", "zh-HK"}, "zh-HK"},
+		{"zh-CN, zh;q=0.9", []string{"zh-Hant", "zh-Hans-SG"}, "zh-Hans-SG"},
+		{"zh", []string{"zh-Hant", "zh-Hans"}, "zh-Hans"},
+		{"sr-Latn, sr;q=0.9", []string{"sr-Cyrl", "sr-Latn-RS"}, "sr-Latn-RS"},
+
+		// Deprecated subtags
+		{"iw", []string{"en", "he"}, "he"},
+		{"he-IL", []string{"iw"}, "iw"},
+		{"in, en;q=0.5", []string{"en", "id-ID"}, "id-ID"},
+		{"he, iw;q=0", []string{"he"}, ""},
+		{"de-CH, de;q=0", []string{"de"}, ""},
+		{"en;q=2", []string{"en"}, ""},
+		{"*", []string{"en"}, ""},
+		{"", []string{"en"}, ""},
+		{"en", nil, ""},
+	} {
+		if got := matchLanguage(c.header, c.available); got != c.want {
+			t.Errorf("%q from %v: %q, want %q", c.header, c.available, got, c.want)
+		}
+	}
+}
+
+func TestValidateLanguages(t *testing.T) {
+
+	ok := map[string]string{"en": "https://example.org/en", "zh-Hant-TW": "https://example.org/tw"}
+	if err := validateLanguages(ok); err != nil {
+		t.Errorf("%v: %s", ok, err)
+	}
+
+	for _, l := range []map[string]string{
+		{"en_GB": "https://example.org/gb"},
+		{"en-unitedkingdom": "https://example.org/gb"},
+		{"en": "https://example.org/en", "EN": "https://example.org/EN"},
+		{"en": "not a url"},
+	} {
+		if err := validateLanguages(l); err == nil {
+			t.Errorf("%v: no error", l)
+		}
+	}
+}
@@ -3,30 +3,154 @@ package main
 import (
 	"github.com/34South/envr"
 	"html/template"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
-var MongoDB *MongoConnection
+var Store LinkStore
+var ShortCodes ShortCodeGenerator
+var Checker *LinkChecker
+var GeoIP *GeoIPReader
+var DefaultRedirectType = http.StatusSeeOther
 var tpl *template.Template
 
 func init() {
 
+	tpl = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("./templates/*.gohtml"))
+}
+
+// loadEnv reads the config from the environment or .env, bailing out if anything required is missing. It isn't
+// done in init so that tests can run without it.
+func loadEnv() {
+
 	envr.New("linkr-env", []string{
-		"MONGO_URL",
-		"MONGO_DB",
-		"MONGO_LINKS_COLLECTION",
-		"MONGO_RESOURCES_COLLECTION",
-		"MONGO_STATS_COLLECTION",
 		"LINKR_BASE_URL",
 	}).Auto()
 
-	tpl = template.Must(template.ParseGlob("./templates/*.gohtml"))
+	// Optional config, set from .env if present but no need to bail out if it isn't
+	envr.New("linkr-options", []string{
+		"LINKR_STORE",
+		"LINKR_STORE_PATH",
+		"LINKR_STORE_RETENTION",
+		"LINKR_API_KEY",
+		"LINKR_COOKIE_SECRET",
+		"LINKR_GEOIP_DB",
+		"LINKR_NAMESPACES",
+		"LINKR_REDIRECT_TYPE",
+		"LINKR_PASSWORD_COOKIE_TTL",
+		"LINKR_SHORTCODE_STRATEGY",
+		"LINKR_SHORTCODE_LENGTH",
+		"LINKR_SHORTCODE_SALT",
+		"LINKR_CHECKER",
+		"LINKR_CHECK_WORKERS",
+		"LINKR_CHECK_INTERVAL",
+		"LINKR_CHECK_MIN_INTERVAL",
+		"LINKR_CHECK_POLL",
+		"LINKR_CHECK_HOST_LIMIT",
+		"LINKR_CHECK_HOST_DELAY",
+		"LINKR_CHECK_MOVED_AFTER",
+		"LINKR_CHECK_SOFT404",
+		"LINKR_CHECK_SOFT404_RULES",
+		"LINKR_CHECK_SOFT404_MIN_BYTES",
+		"MONGO_CHECKS_COLLECTION",
+		"MONGO_COUNTERS_COLLECTION",
+		"MONGO_RULES_COLLECTION",
+	}).Passive()
+
+	// Only need Mongo config if we are using Mongo
+	if storeKind() == "mongo" {
+		envr.New("linkr-mongo", []string{
+			"MONGO_URL",
+			"MONGO_DB",
+			"MONGO_LINKS_COLLECTION",
+			"MONGO_RESOURCES_COLLECTION",
+			"MONGO_STATS_COLLECTION",
+		}).Auto()
+	}
 }
 
 func main() {
 
-	// Create a connection to MongoDB
-	MongoDB = NewMongoConnection()
+	loadEnv()
+
+	// For cookies that remember link passwords
+	initCookieSecret()
+
+	// A/B splits and checker jitter shouldn't repeat the same sequence after every restart
+	rand.Seed(time.Now().UnixNano())
+
+	// Namespaces for teams to keep their links in
+	err := initNamespaces()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// How links redirect unless they say otherwise
+	if v := os.Getenv("LINKR_REDIRECT_TYPE"); v != "" {
+		DefaultRedirectType, _ = strconv.Atoi(v)
+		if !validRedirectTypes[DefaultRedirectType] {
+			log.Fatalln("LINKR_REDIRECT_TYPE must be one of 301, 302, 303, 307 or 308")
+		}
+	}
+
+	// Set up the link store, MongoDB unless LINKR_STORE says otherwise
+	Store, err = NewLinkStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// The file store saves clicks a moment after they happen, so needs a chance to on the way out
+	if fs, ok := Store.(*FileStore); ok {
+		fs.FlushOnExit()
+	}
+
+	// Country lookups for geo targeting and stats, if there is a GeoIP database
+	if path := os.Getenv("LINKR_GEOIP_DB"); path != "" {
+		GeoIP, err = OpenGeoIP(path)
+		if err != nil {
+			log.Fatalln("GeoIP database:", err)
+		}
+	}
+
+	// Short codes for links created without a vanity slug
+	ShortCodes, err = ShortCodeGeneratorFromEnv(Store)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Commands such as `linkr import` work on the store then exit, without the checker or the router
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	// Background link checker, unless switched off
+	if os.Getenv("LINKR_CHECKER") != "off" {
+		Checker = NewLinkChecker(Store)
+		Checker.Soft404, err = NewSoft404DetectorFromEnv()
+		if err != nil {
+			log.Fatalln("Soft 404 rules:", err)
+		}
+		Checker.Start()
+	}
 
 	// Fire up the router
 	Start()
 }
+
+// templateFuncs are available to all the templates
+var templateFuncs = template.FuncMap{
+	// dict builds a map from key, value pairs so a sub-template can be passed more than one thing
+	"dict": func(kv ...interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		for i := 0; i+1 < len(kv); i += 2 {
+			if k, ok := kv[i].(string); ok {
+				m[k] = kv[i+1]
+			}
+		}
+		return m
+	},
+}
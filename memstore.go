@@ -0,0 +1,449 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStore is a LinkStore that lives in memory only, handy for tests and trying things out.
+// Everything is lost when the process exits.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	links     map[string]LinkDoc
+	stats     []LinkStatsDoc
+	checks    []LinkCheckDoc
+	resources []ResourcesDoc
+	counters  map[string]int64
+	rules     []RuleDoc
+}
+
+func NewMemoryStore() *MemoryStore {
+
+	return &MemoryStore{
+		links:    make(map[string]LinkDoc),
+		counters: make(map[string]int64),
+	}
+}
+
+func (m *MemoryStore) FindLink(shortUrl string) (LinkDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	l, ok := m.links[shortUrl]
+	if !ok {
+		return LinkDoc{}, ErrNotFound
+	}
+
+	return copyLink(l), nil
+}
+
+// copyLink makes a deep copy of ld, so that a caller changing the doc it found, as UpdateLinkHandler does when
+// it decodes over it, or the doc it added or updated with, doesn't change the stored one. New pointer, slice or
+// map fields need copying here too.
+func copyLink(ld LinkDoc) LinkDoc {
+
+	if ld.ActiveFrom != nil {
+		t := *ld.ActiveFrom
+		ld.ActiveFrom = &t
+	}
+	if ld.ExpiresAt != nil {
+		t := *ld.ExpiresAt
+		ld.ExpiresAt = &t
+	}
+	if ld.Targets != nil {
+		ld.Targets = append([]TargetRule(nil), ld.Targets...)
+	}
+	if ld.GeoTargets != nil {
+		gs := make([]GeoRule, len(ld.GeoTargets))
+		for i, g := range ld.GeoTargets {
+			g.Countries = append([]string(nil), g.Countries...)
+			gs[i] = g
+		}
+		ld.GeoTargets = gs
+	}
+	if ld.Languages != nil {
+		l := make(LanguageURLs, len(ld.Languages))
+		for k, v := range ld.Languages {
+			l[k] = v
+		}
+		ld.Languages = l
+	}
+	if ld.Variants != nil {
+		ld.Variants = append([]Variant(nil), ld.Variants...)
+	}
+	if ld.Schedule != nil {
+		ld.Schedule = append([]ScheduleEntry(nil), ld.Schedule...)
+	}
+	if ld.UTM != nil {
+		u := *ld.UTM
+		ld.UTM = &u
+	}
+	if ld.StripParams != nil {
+		ld.StripParams = append([]string(nil), ld.StripParams...)
+	}
+
+	return ld
+}
+
+func (m *MemoryStore) AddLink(ld LinkDoc) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.links[ld.ShortUrl]; ok {
+		return ErrDuplicateLink
+	}
+	m.links[ld.ShortUrl] = copyLink(ld)
+
+	return nil
+}
+
+func (m *MemoryStore) UpdateLink(shortUrl string, ld LinkDoc) (LinkDoc, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.links[shortUrl]
+	if !ok {
+		return LinkDoc{}, ErrNotFound
+	}
+	if _, ok := m.links[ld.ShortUrl]; ok && ld.ShortUrl != shortUrl {
+		return LinkDoc{}, ErrDuplicateLink
+	}
+
+	// Clicks are only ever changed by IncrementClicks
+	ld.ID = old.ID
+	ld.Clicks = old.Clicks
+	delete(m.links, shortUrl)
+	m.links[ld.ShortUrl] = copyLink(ld)
+
+	return ld, nil
+}
+
+func (m *MemoryStore) DeleteLink(shortUrl string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.links[shortUrl]; !ok {
+		return ErrNotFound
+	}
+	delete(m.links, shortUrl)
+
+	return nil
+}
+
+func (m *MemoryStore) IncrementClicks(shortUrl string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.links[shortUrl]
+	if !ok {
+		return ErrNotFound
+	}
+	l.Clicks++
+	m.links[shortUrl] = l
+
+	return nil
+}
+
+func (m *MemoryStore) RecordStats(s LinkStatsDoc) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats = append(m.stats, s)
+
+	return nil
+}
+
+func (m *MemoryStore) LinkStats(linkID bson.ObjectId, from, to time.Time) ([]LinkStatsDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var r []LinkStatsDoc
+	for _, s := range m.stats {
+		if s.LinkID == linkID && !s.CreatedAt.Before(from) && s.CreatedAt.Before(to) {
+			r = append(r, s)
+		}
+	}
+
+	return r, nil
+}
+
+func (m *MemoryStore) ClickCounts(linkID bson.ObjectId, from, to time.Time, interval string) ([]ClickGroup, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[ClickGroup]int)
+	for _, s := range m.stats {
+		if s.LinkID == linkID && !s.CreatedAt.Before(from) && s.CreatedAt.Before(to) {
+			g := ClickGroup{
+				Start:    truncateInterval(s.CreatedAt, interval),
+				Referrer: s.Referrer,
+				Agent:    s.Agent,
+				Country:  s.Country,
+				Variant:  s.Variant,
+			}
+			counts[g]++
+		}
+	}
+
+	r := make([]ClickGroup, 0, len(counts))
+	for g, n := range counts {
+		g.Clicks = n
+		r = append(r, g)
+	}
+
+	return r, nil
+}
+
+func (m *MemoryStore) UpdateCheckState(shortUrl string, lc LinkCheckDoc, failures int, movedTo string, nextCheckAt time.Time) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.links[shortUrl]
+	if !ok {
+		return ErrNotFound
+	}
+	l.LastStatusCode = lc.StatusCode
+	l.LastErrorClass = lc.ErrorClass
+	l.LastError = lc.Error
+	l.CheckFailures = failures
+	l.MovedTo = movedTo
+	l.LastCheckedAt = lc.CreatedAt
+	l.NextCheckAt = nextCheckAt
+	m.links[shortUrl] = l
+
+	return nil
+}
+
+func (m *MemoryStore) RecordCheck(lc LinkCheckDoc) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checks = append(m.checks, lc)
+
+	return nil
+}
+
+func (m *MemoryStore) Checks(linkID bson.ObjectId, n int) ([]LinkCheckDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Checks are appended as they happen so walk backwards for newest first
+	var r []LinkCheckDoc
+	for i := len(m.checks) - 1; i >= 0 && (n <= 0 || len(r) < n); i-- {
+		if m.checks[i].LinkID == linkID {
+			r = append(r, m.checks[i])
+		}
+	}
+
+	return r, nil
+}
+
+func (m *MemoryStore) DueLinks(t time.Time, n int) ([]LinkDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var r []LinkDoc
+	for _, l := range m.links {
+		if l.Active && !l.NextCheckAt.After(t) {
+			r = append(r, l)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].NextCheckAt.Before(r[j].NextCheckAt) })
+
+	return limitLinks(r, n), nil
+}
+
+func (m *MemoryStore) Popular(namespace string, n int) ([]LinkDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var r []LinkDoc
+	for _, l := range m.links {
+		if l.Clicks > 0 && (namespace == "" || l.Namespace == namespace) {
+			r = append(r, l)
+		}
+	}
+	sortByClicks(r)
+
+	return limitLinks(r, n), nil
+}
+
+func (m *MemoryStore) Trending(since time.Time, n int) ([]TrendingLink, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[bson.ObjectId]int)
+	for _, s := range m.stats {
+		if !s.CreatedAt.Before(since) {
+			counts[s.LinkID]++
+		}
+	}
+
+	var r []TrendingLink
+	for _, l := range m.links {
+		if counts[l.ID] > 0 {
+			r = append(r, TrendingLink{LinkDoc: l, RecentClicks: counts[l.ID]})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].RecentClicks != r[j].RecentClicks {
+			return r[i].RecentClicks > r[j].RecentClicks
+		}
+		return r[i].ShortUrl < r[j].ShortUrl
+	})
+	if n > 0 && len(r) > n {
+		r = r[:n]
+	}
+
+	return r, nil
+}
+
+// Latest returns active resources ordered by pubDate.date desc
+func (m *MemoryStore) Latest(namespace string, n int) ([]ResourcesDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var r []ResourcesDoc
+	for _, rd := range m.resources {
+		if rd.Active && (namespace == "" || strings.HasPrefix(rd.ShortUrl, namespace+"/")) {
+			r = append(r, rd)
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].PubDate.Date.After(r[j].PubDate.Date) })
+	if n > 0 && len(r) > n {
+		r = r[:n]
+	}
+
+	return r, nil
+}
+
+func (m *MemoryStore) Broken() ([]LinkDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var r []LinkDoc
+	for _, l := range m.links {
+		if l.LastStatusCode != 0 && l.LastStatusCode != 200 || l.LastErrorClass == CheckErrorSoft404 {
+			r = append(r, l)
+		}
+	}
+	sortByClicks(r)
+
+	return r, nil
+}
+
+func (m *MemoryStore) Moved() ([]LinkDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var r []LinkDoc
+	for _, l := range m.links {
+		if l.MovedTo != "" {
+			r = append(r, l)
+		}
+	}
+	sortByClicks(r)
+
+	return r, nil
+}
+
+func (m *MemoryStore) Links() ([]LinkDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := make([]LinkDoc, 0, len(m.links))
+	for _, l := range m.links {
+		r = append(r, l)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ShortUrl < r[j].ShortUrl })
+
+	return r, nil
+}
+
+func (m *MemoryStore) NextSequence(name string) (int64, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name]++
+
+	return m.counters[name], nil
+}
+
+// Rules returns a copy of the rules, which are kept in the order they are tried
+func (m *MemoryStore) Rules() ([]RuleDoc, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]RuleDoc(nil), m.rules...), nil
+}
+
+func (m *MemoryStore) SetRules(rules []RuleDoc) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rules = append([]RuleDoc(nil), rules...)
+	sort.SliceStable(m.rules, func(i, j int) bool { return m.rules[i].Position < m.rules[j].Position })
+
+	return nil
+}
+
+func (m *MemoryStore) IncrementRuleHits(id bson.ObjectId) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.rules {
+		if m.rules[i].ID == id {
+			m.rules[i].Hits++
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// sortByClicks orders r by clicks desc, breaking ties on shortUrl so results don't shuffle between calls
+func sortByClicks(r []LinkDoc) {
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Clicks != r[j].Clicks {
+			return r[i].Clicks > r[j].Clicks
+		}
+		return r[i].ShortUrl < r[j].ShortUrl
+	})
+}
+
+// limitLinks trims r to n links, where n <= 0 means no limit (as per mgo Query.Limit)
+func limitLinks(r []LinkDoc, n int) []LinkDoc {
+
+	if n > 0 && len(r) > n {
+		return r[:n]
+	}
+
+	return r
+}
@@ -6,30 +6,110 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"log"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"time"
 )
 
+// ErrDuplicateLink is returned when a link with the same shortUrl already exists
+var ErrDuplicateLink = errors.New("Duplicate value for shortUrl")
+
 type LinkDoc struct {
-	ID             bson.ObjectId `json:"_id,omitempty" bson:"_id"`
-	CreatedAt      time.Time     `json:"createdAt" bson:"createdAt"`
-	UpdatedAt      time.Time     `json:"updatedAt" bson:"updatedAt"`
-	ShortUrl       string        `json:"shortUrl" bson:"shortUrl"`
-	LongUrl        string        `json:"longUrl" bson:"longUrl"`
-	Title          string        `json:"title" bson:"title"`
-	Clicks         int           `json:"clicks" bson:"clicks"`
-	LastStatusCode int           `json:"lastStatusCode" bson:"lastStatusCode"`
-	Active         bool          `json:"active"`
+	ID             bson.ObjectId   `json:"_id,omitempty" bson:"_id"`
+	CreatedAt      time.Time       `json:"createdAt" bson:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt" bson:"updatedAt"`
+	ShortUrl       string          `json:"shortUrl" bson:"shortUrl"`
+	LongUrl        string          `json:"longUrl" bson:"longUrl"`
+	Title          string          `json:"title" bson:"title"`
+	Clicks         int             `json:"clicks" bson:"clicks"`
+	LastStatusCode int             `json:"lastStatusCode" bson:"lastStatusCode"`
+	LastCheckedAt  time.Time       `json:"lastCheckedAt" bson:"lastCheckedAt"`
+	NextCheckAt    time.Time       `json:"nextCheckAt" bson:"nextCheckAt"`
+	CheckFailures  int             `json:"checkFailures" bson:"checkFailures"`
+	LastErrorClass string          `json:"lastErrorClass,omitempty" bson:"lastErrorClass,omitempty"`
+	LastError      string          `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	MovedTo        string          `json:"movedTo,omitempty" bson:"movedTo,omitempty"`
+	Active         bool            `json:"active"`
+	ActiveFrom     *time.Time      `json:"activeFrom,omitempty" bson:"activeFrom,omitempty"`
+	ExpiresAt      *time.Time      `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	MaxClicks      int             `json:"maxClicks,omitempty" bson:"maxClicks,omitempty"`
+	PasswordHash   string          `json:"passwordHash,omitempty" bson:"passwordHash,omitempty"`
+	Targets        []TargetRule    `json:"targets,omitempty" bson:"targets,omitempty"`
+	GeoTargets     []GeoRule       `json:"geoTargets,omitempty" bson:"geoTargets,omitempty"`
+	Languages      LanguageURLs    `json:"languages,omitempty" bson:"languages,omitempty"`
+	Variants       []Variant       `json:"variants,omitempty" bson:"variants,omitempty"`
+	Schedule       []ScheduleEntry `json:"schedule,omitempty" bson:"schedule,omitempty"`
+	PassQuery      bool            `json:"passQuery,omitempty" bson:"passQuery,omitempty"`
+	UTM            *UTMParams      `json:"utm,omitempty" bson:"utm,omitempty"`
+	StripParams    []string        `json:"stripParams,omitempty" bson:"stripParams,omitempty"`
+	RedirectType   int             `json:"redirectType,omitempty" bson:"redirectType,omitempty"`
+	Prefix         bool            `json:"prefix,omitempty" bson:"prefix,omitempty"`
+	Namespace      string          `json:"namespace,omitempty" bson:"namespace,omitempty"`
 }
 
+// LinkStatsDoc records a click
 type LinkStatsDoc struct {
+	ID        bson.ObjectId `json:"_id,omitempty" bson:"_id"`
+	LinkID    bson.ObjectId `json:"linkId" bson:"linkId"`
+	CreatedAt time.Time     `json:"createdAt" bson:"createdAt"`
+	Referrer  string        `json:"referrer" bson:"referrer"`
+	Agent     string        `json:"agent" bson:"agent"`
+	Variant   string        `json:"variant,omitempty" bson:"variant,omitempty"`
+	Country   string        `json:"country,omitempty" bson:"country,omitempty"`
+	Path      string        `json:"path,omitempty" bson:"path,omitempty"`
+}
+
+// ClickGroup is the number of clicks on a link in the interval starting at Start that had the same referrer, agent,
+// country and variant. The analytics are summed from these so that only the counts come from the database.
+type ClickGroup struct {
+	Start    time.Time
+	Referrer string
+	Agent    string
+	Country  string
+	Variant  string
+	Clicks   int
+}
+
+// TrendingLink is a link with the number of clicks it had in a recent window
+type TrendingLink struct {
+	LinkDoc      `bson:",inline"`
+	RecentClicks int `json:"recentClicks" bson:"recentClicks"`
+}
+
+// LinkCheckDoc records the result of checking a link's long url
+type LinkCheckDoc struct {
 	ID         bson.ObjectId `json:"_id,omitempty" bson:"_id"`
 	LinkID     bson.ObjectId `json:"linkId" bson:"linkId"`
 	CreatedAt  time.Time     `json:"createdAt" bson:"createdAt"`
-	Referrer   string        `json:"referrer" bson:"referrer"`
-	Agent      string        `json:"agent" bson:"agent"`
 	StatusCode int           `json:"statusCode" bson:"statusCode"`
+	LatencyMs  int64         `json:"latencyMs" bson:"latencyMs"`
+	ErrorClass string        `json:"errorClass,omitempty" bson:"errorClass,omitempty"`
+	Error      string        `json:"error,omitempty" bson:"error,omitempty"`
+	FinalUrl   string        `json:"finalUrl,omitempty" bson:"finalUrl,omitempty"`
+	Redirects  []RedirectHop `json:"redirects,omitempty" bson:"redirects,omitempty"`
 }
 
+// RedirectHop is a redirect followed while checking a link, the url requested and the status that redirected from it
+type RedirectHop struct {
+	Url        string `json:"url" bson:"url"`
+	StatusCode int    `json:"statusCode" bson:"statusCode"`
+}
+
+// Error classes for a LinkCheckDoc. Apart from http and soft404, the server didn't respond.
+const (
+	CheckErrorHTTP      = "http"      // the server responded, but not with 200
+	CheckErrorSoft404   = "soft404"   // the server responded 200, but with a "not found" page
+	CheckErrorDNS       = "dns"       // the host name couldn't be looked up
+	CheckErrorRefused   = "refused"   // nothing is listening on the host and port
+	CheckErrorReset     = "reset"     // the connection was reset or closed early
+	CheckErrorTimeout   = "timeout"   // no response in time
+	CheckErrorTLS       = "tls"       // the TLS handshake or certificate failed
+	CheckErrorRedirects = "redirects" // more than maxRedirects redirects
+	CheckErrorURL       = "url"       // the long url can't be requested at all
+	CheckErrorNetwork   = "network"   // any other failure to get a response
+)
+
 type ResourcesDoc struct {
 	ID          bson.ObjectId `json:"_id,omitempty" bson:"_id"`
 	CreatedAt   time.Time     `json:"createdAt" bson:"createdAt"`
@@ -65,6 +145,28 @@ type MongoConnection struct {
 	LinksCol     string
 	ResourcesCol string
 	StatsCol     string
+	ChecksCol    string
+	CountersCol  string
+	RulesCol     string
+}
+
+// RuleDoc is a redirect rule, tried in order of position for paths that have no link. A path that matches
+// pattern goes to template, with $1, ${name} and so on replaced by the pattern's submatches.
+type RuleDoc struct {
+	ID        bson.ObjectId `json:"_id,omitempty" bson:"_id"`
+	Position  int           `json:"position" bson:"position"`
+	Pattern   string        `json:"pattern" bson:"pattern"`
+	Template  string        `json:"template" bson:"template"`
+	Title     string        `json:"title,omitempty" bson:"title,omitempty"`
+	Hits      int           `json:"hits" bson:"hits"`
+	CreatedAt time.Time     `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt" bson:"updatedAt"`
+}
+
+// CounterDoc holds the current value of a named sequence
+type CounterDoc struct {
+	ID  string `json:"_id" bson:"_id"`
+	Seq int64  `json:"seq" bson:"seq"`
 }
 
 func NewMongoConnection() *MongoConnection {
@@ -75,6 +177,18 @@ func NewMongoConnection() *MongoConnection {
 	c.LinksCol = os.Getenv("MONGO_LINKS_COLLECTION")
 	c.ResourcesCol = os.Getenv("MONGO_RESOURCES_COLLECTION")
 	c.StatsCol = os.Getenv("MONGO_STATS_COLLECTION")
+	c.ChecksCol = os.Getenv("MONGO_CHECKS_COLLECTION")
+	if c.ChecksCol == "" {
+		c.ChecksCol = "checks"
+	}
+	c.CountersCol = os.Getenv("MONGO_COUNTERS_COLLECTION")
+	if c.CountersCol == "" {
+		c.CountersCol = "counters"
+	}
+	c.RulesCol = os.Getenv("MONGO_RULES_COLLECTION")
+	if c.RulesCol == "" {
+		c.RulesCol = "rules"
+	}
 	c.CreateConnection()
 
 	return c
@@ -118,6 +232,10 @@ func (c *MongoConnection) CreateConnection() (err error) {
 	}
 	LinksCollection.EnsureIndex(index)
 
+	// Stats and check history are always looked up per link, by date
+	c.Session.DB(c.DB).C(c.StatsCol).EnsureIndexKey("linkId", "createdAt")
+	c.Session.DB(c.DB).C(c.ChecksCol).EnsureIndexKey("linkId", "-createdAt")
+
 	return err
 }
 
@@ -163,6 +281,67 @@ func (c *MongoConnection) sessionStatsCollection() (session *mgo.Session, urlCol
 	return
 }
 
+func (c *MongoConnection) sessionChecksCollection() (session *mgo.Session, urlCollection *mgo.Collection, err error) {
+
+	if c.Session != nil {
+		session = c.Session.Copy()
+		urlCollection = session.DB(c.DB).C(c.ChecksCol)
+	} else {
+		err = errors.New("No original session found")
+	}
+
+	return
+}
+
+func (c *MongoConnection) sessionCountersCollection() (session *mgo.Session, urlCollection *mgo.Collection, err error) {
+
+	if c.Session != nil {
+		session = c.Session.Copy()
+		urlCollection = session.DB(c.DB).C(c.CountersCol)
+	} else {
+		err = errors.New("No original session found")
+	}
+
+	return
+}
+
+func (c *MongoConnection) sessionRulesCollection() (session *mgo.Session, urlCollection *mgo.Collection, err error) {
+
+	if c.Session != nil {
+		session = c.Session.Copy()
+		urlCollection = session.DB(c.DB).C(c.RulesCol)
+	} else {
+		err = errors.New("No original session found")
+	}
+
+	return
+}
+
+// NextSequence atomically increments the named counter and returns the new value
+func (c *MongoConnection) NextSequence(name string) (int64, error) {
+
+	cd := CounterDoc{}
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionCountersCollection()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	_, err = collection.FindId(name).Apply(change, &cd)
+	if err != nil {
+		return 0, err
+	}
+
+	return cd.Seq, nil
+}
+
 func (c *MongoConnection) FindShortUrl(longurl string) (sUrl string, err error) {
 
 	//create an empty document struct
@@ -195,6 +374,9 @@ func (c *MongoConnection) FindLink(shortUrl string) (LinkDoc, error) {
 
 	//Find the link doc
 	err = lc.Find(bson.M{"shortUrl": shortUrl}).One(&l)
+	if err == mgo.ErrNotFound {
+		return l, ErrNotFound
+	}
 	if err != nil {
 		return l, err
 	}
@@ -202,6 +384,7 @@ func (c *MongoConnection) FindLink(shortUrl string) (LinkDoc, error) {
 	return l, nil
 }
 
+// AddLink inserts a new link doc, returning ErrDuplicateLink if the shortUrl is taken
 func (c *MongoConnection) AddLink(ld LinkDoc) error {
 
 	//get a copy of the session
@@ -211,23 +394,136 @@ func (c *MongoConnection) AddLink(ld LinkDoc) error {
 	}
 	defer session.Close()
 
-	// Use shortlink as a selector for an upsert
-	s := bson.M{"shortUrl": ld.ShortUrl}
+	// The unique index should catch this but it is cheap to check first
+	n, err := lc.Find(bson.M{"shortUrl": ld.ShortUrl}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicateLink
+	}
 
 	//insert a document with the provided function arguments
-	err = lc.UpdateId(s, ld)
+	err = lc.Insert(ld)
 	if err != nil {
-		// No need as we are upserting
-		////check if the error is due to duplicate shorturl
-		//if mgo.IsDup(err) {
-		//	err = errors.New("Duplicate value for shortUrl")
-		//}
+		//check if the error is due to duplicate shorturl
+		if mgo.IsDup(err) {
+			err = ErrDuplicateLink
+		}
 		return err
 	}
 
 	return nil
 }
 
+// UpdateLink replaces the link doc identified by shortUrl with ld, leaving the clicks counter alone, and
+// returns the updated doc
+func (c *MongoConnection) UpdateLink(shortUrl string, ld LinkDoc) (LinkDoc, error) {
+
+	l := LinkDoc{}
+
+	//get a copy of the session
+	session, lc, err := c.sessionLinksCollection()
+	if err != nil {
+		return l, err
+	}
+	defer session.Close()
+
+	// Renaming a link must not clobber another one
+	if ld.ShortUrl != shortUrl {
+		n, err := lc.Find(bson.M{"shortUrl": ld.ShortUrl}).Count()
+		if err != nil {
+			return l, err
+		}
+		if n > 0 {
+			return l, ErrDuplicateLink
+		}
+	}
+
+	// $set every field except the id and clicks, which may be incremented while we are here
+	f := bson.M{}
+	b, err := bson.Marshal(ld)
+	if err != nil {
+		return l, err
+	}
+	err = bson.Unmarshal(b, &f)
+	if err != nil {
+		return l, err
+	}
+	delete(f, "_id")
+	delete(f, "clicks")
+
+	// Optional fields left out by omitempty have been cleared, so unset them
+	u := bson.M{"$set": f}
+	unset := bson.M{}
+	for _, k := range bsonKeys(ld) {
+		if _, ok := f[k]; !ok && k != "_id" && k != "clicks" {
+			unset[k] = ""
+		}
+	}
+	if len(unset) > 0 {
+		u["$unset"] = unset
+	}
+
+	change := mgo.Change{
+		Update:    u,
+		ReturnNew: true,
+	}
+	_, err = lc.Find(bson.M{"shortUrl": shortUrl}).Apply(change, &l)
+	if err == mgo.ErrNotFound {
+		return l, ErrNotFound
+	}
+	if err != nil {
+		if mgo.IsDup(err) {
+			err = ErrDuplicateLink
+		}
+		return l, err
+	}
+
+	return l, nil
+}
+
+// bsonKeys lists the top level keys that the struct v is stored under, as per the mgo bson rules
+func bsonKeys(v interface{}) []string {
+
+	var keys []string
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		k := strings.Split(f.Tag.Get("bson"), ",")[0]
+		if k == "-" {
+			continue
+		}
+		if k == "" {
+			k = strings.ToLower(f.Name)
+		}
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// DeleteLink removes the link doc identified by shortUrl
+func (c *MongoConnection) DeleteLink(shortUrl string) error {
+
+	//get a copy of the session
+	session, lc, err := c.sessionLinksCollection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = lc.Remove(bson.M{"shortUrl": shortUrl})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+
+	return err
+}
+
 func (c *MongoConnection) IncrementClicks(shortUrl string) error {
 
 	//get a copy of the original session and a collection
@@ -244,38 +540,199 @@ func (c *MongoConnection) IncrementClicks(shortUrl string) error {
 	return nil
 }
 
-func (c *MongoConnection) UpdateStatusCode(shortUrl string, statusCode int) error {
+func (c *MongoConnection) RecordStats(s LinkStatsDoc) error {
 
-	session, urlCollection, err := c.sessionLinksCollection()
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionStatsCollection()
 	if err != nil {
 		return err
 	}
 	defer session.Close()
 
-	err = urlCollection.Update(bson.M{"shortUrl": shortUrl}, bson.M{"$set": bson.M{"lastStatusCode": statusCode}})
+	err = collection.Insert(s)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *MongoConnection) RecordStats(s LinkStatsDoc) error {
+// LinkStats returns the clicks on a link from 'from' up to, but not including, 'to'
+func (c *MongoConnection) LinkStats(linkID bson.ObjectId, from, to time.Time) ([]LinkStatsDoc, error) {
+
+	var r []LinkStatsDoc
 
 	//get a copy of the original session and a collection
 	session, collection, err := c.sessionStatsCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	q := bson.M{
+		"linkId":    linkID,
+		"createdAt": bson.M{"$gte": from, "$lt": to},
+	}
+	err = collection.Find(q).Sort("createdAt").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// ClickCounts returns the clicks on a link from 'from' up to, but not including, 'to', counted by interval and
+// the same referrer, agent, country and variant
+func (c *MongoConnection) ClickCounts(linkID bson.ObjectId, from, to time.Time, interval string) ([]ClickGroup, error) {
+
+	var r []ClickGroup
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionStatsCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	// Intervals are a fixed number of ms in UTC, so a click's is the ms since the start of the first one rounded
+	// down to a multiple of that
+	start := truncateInterval(from, interval)
+	ms := int64(intervalDuration(interval) / time.Millisecond)
+	var groups []struct {
+		ID struct {
+			Offset   int64  `bson:"offset"`
+			Referrer string `bson:"referrer"`
+			Agent    string `bson:"agent"`
+			Country  string `bson:"country"`
+			Variant  string `bson:"variant"`
+		} `bson:"_id"`
+		Clicks int `bson:"clicks"`
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"linkId": linkID, "createdAt": bson.M{"$gte": from, "$lt": to}}},
+		{"$project": bson.M{
+			"referrer": 1, "agent": 1, "country": 1, "variant": 1,
+			"offset": bson.M{"$subtract": []interface{}{"$createdAt", start}},
+		}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"offset":   bson.M{"$subtract": []interface{}{"$offset", bson.M{"$mod": []interface{}{"$offset", ms}}}},
+				"referrer": "$referrer",
+				"agent":    "$agent",
+				"country":  "$country",
+				"variant":  "$variant",
+			},
+			"clicks": bson.M{"$sum": 1},
+		}},
+	}
+	err = collection.Pipe(pipeline).All(&groups)
+	if err != nil {
+		return r, err
+	}
+
+	for _, g := range groups {
+		r = append(r, ClickGroup{
+			Start:    start.Add(time.Duration(g.ID.Offset) * time.Millisecond),
+			Referrer: g.ID.Referrer,
+			Agent:    g.ID.Agent,
+			Country:  g.ID.Country,
+			Variant:  g.ID.Variant,
+			Clicks:   g.Clicks,
+		})
+	}
+
+	return r, nil
+}
+
+// UpdateCheckState records the outcome of a link check on the link doc, and when it is next due
+func (c *MongoConnection) UpdateCheckState(shortUrl string, lc LinkCheckDoc, failures int, movedTo string, nextCheckAt time.Time) error {
+
+	session, urlCollection, err := c.sessionLinksCollection()
 	if err != nil {
 		return err
 	}
 	defer session.Close()
 
-	err = collection.Insert(s)
+	err = urlCollection.Update(bson.M{"shortUrl": shortUrl}, bson.M{"$set": bson.M{
+		"lastStatusCode": lc.StatusCode,
+		"lastErrorClass": lc.ErrorClass,
+		"lastError":      lc.Error,
+		"checkFailures":  failures,
+		"movedTo":        movedTo,
+		"lastCheckedAt":  lc.CreatedAt,
+		"nextCheckAt":    nextCheckAt,
+	}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecordCheck stores the result of a link check, separately from the click stats
+func (c *MongoConnection) RecordCheck(lc LinkCheckDoc) error {
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionChecksCollection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = collection.Insert(lc)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *MongoConnection) Popular(n int) ([]LinkDoc, error) {
+// Checks returns the n most recent checks of a link
+func (c *MongoConnection) Checks(linkID bson.ObjectId, n int) ([]LinkCheckDoc, error) {
+
+	var r []LinkCheckDoc
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionChecksCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	err = collection.Find(bson.M{"linkId": linkID}).Limit(n).Sort("-createdAt").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// DueLinks returns up to n active links whose next check is due at t, most overdue first.
+// Links that have never been checked have no nextCheckAt so are always due.
+func (c *MongoConnection) DueLinks(t time.Time, n int) ([]LinkDoc, error) {
+
+	var r []LinkDoc
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionLinksCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	q := bson.M{
+		"active": true,
+		"$or": []bson.M{
+			{"nextCheckAt": bson.M{"$exists": false}},
+			{"nextCheckAt": bson.M{"$lte": t}},
+		},
+	}
+	err = collection.Find(q).Limit(n).Sort("nextCheckAt").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+func (c *MongoConnection) Popular(namespace string, n int) ([]LinkDoc, error) {
 
 	var r []LinkDoc
 
@@ -286,16 +743,59 @@ func (c *MongoConnection) Popular(n int) ([]LinkDoc, error) {
 	}
 	defer session.Close()
 
-	err = collection.Find(bson.M{"clicks": bson.M{"$gt": 0}}).Limit(n).Sort("-clicks").All(&r)
+	q := bson.M{"clicks": bson.M{"$gt": 0}}
+	if namespace != "" {
+		q["namespace"] = namespace
+	}
+	err = collection.Find(q).Limit(n).Sort("-clicks").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// Trending returns the n links with the most clicks since the given time, most first
+func (c *MongoConnection) Trending(since time.Time, n int) ([]TrendingLink, error) {
+
+	var r []TrendingLink
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionStatsCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	// Count the clicks per link in the window, joined to the link itself. Rule hits, whose linkId is a rule's, and
+	// links deleted since they were clicked have no link so are dropped before the limit, which would otherwise
+	// leave fewer than n.
+	var counts []struct {
+		Clicks int     `bson:"clicks"`
+		Link   LinkDoc `bson:"link"`
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"createdAt": bson.M{"$gte": since}}},
+		{"$group": bson.M{"_id": "$linkId", "clicks": bson.M{"$sum": 1}}},
+		{"$lookup": bson.M{"from": c.LinksCol, "localField": "_id", "foreignField": "_id", "as": "link"}},
+		{"$unwind": "$link"},
+		{"$sort": bson.D{{Name: "clicks", Value: -1}, {Name: "link.shortUrl", Value: 1}}},
+		{"$limit": n},
+	}
+	err = collection.Pipe(pipeline).All(&counts)
 	if err != nil {
 		return r, err
 	}
 
+	for _, ct := range counts {
+		r = append(r, TrendingLink{LinkDoc: ct.Link, RecentClicks: ct.Clicks})
+	}
+
 	return r, nil
 }
 
 // Latest queries the Resources collection and orders by pubDate.date desc
-func (c *MongoConnection) Latest(n int) ([]ResourcesDoc, error) {
+func (c *MongoConnection) Latest(namespace string, n int) ([]ResourcesDoc, error) {
 
 	var r []ResourcesDoc
 
@@ -306,7 +806,12 @@ func (c *MongoConnection) Latest(n int) ([]ResourcesDoc, error) {
 	}
 	defer session.Close()
 
-	err = collection.Find(bson.M{"active": true}).Limit(n).Sort("-pubDate.date").All(&r)
+	// Resources are matched to links by shortUrl, which starts with the namespace
+	q := bson.M{"active": true}
+	if namespace != "" {
+		q["shortUrl"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(namespace+"/")}
+	}
+	err = collection.Find(q).Limit(n).Sort("-pubDate.date").All(&r)
 	if err != nil {
 		return r, err
 	}
@@ -325,10 +830,114 @@ func (c *MongoConnection) Broken() ([]LinkDoc, error) {
 	}
 	defer session.Close()
 
-	err = collection.Find(bson.M{"lastStatusCode": bson.M{"$exists": true, "$nin": []int{200, 0}}}).Sort("-clicks").All(&r)
+	err = collection.Find(bson.M{"$or": []bson.M{
+		{"lastStatusCode": bson.M{"$exists": true, "$nin": []int{200, 0}}},
+		{"lastErrorClass": CheckErrorSoft404},
+	}}).Sort("-clicks").All(&r)
 	if err != nil {
 		return r, err
 	}
 
 	return r, nil
 }
+
+// Moved returns the links found to have permanently moved, most clicked first
+func (c *MongoConnection) Moved() ([]LinkDoc, error) {
+
+	var r []LinkDoc
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionLinksCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	err = collection.Find(bson.M{"movedTo": bson.M{"$exists": true, "$ne": ""}}).Sort("-clicks").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// Links returns every link, in shortUrl order
+func (c *MongoConnection) Links() ([]LinkDoc, error) {
+
+	var r []LinkDoc
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionLinksCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	err = collection.Find(nil).Sort("shortUrl").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// Rules returns the redirect rules in the order they are tried
+func (c *MongoConnection) Rules() ([]RuleDoc, error) {
+
+	var r []RuleDoc
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionRulesCollection()
+	if err != nil {
+		return r, err
+	}
+	defer session.Close()
+
+	err = collection.Find(nil).Sort("position").All(&r)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// SetRules replaces the whole rule set. Hits counted while it runs may be lost, which is fine for an admin action.
+func (c *MongoConnection) SetRules(rules []RuleDoc) error {
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionRulesCollection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	_, err = collection.RemoveAll(nil)
+	if err != nil {
+		return err
+	}
+	for _, rd := range rules {
+		err = collection.Insert(rd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IncrementRuleHits counts a redirect made by a rule
+func (c *MongoConnection) IncrementRuleHits(id bson.ObjectId) error {
+
+	//get a copy of the original session and a collection
+	session, collection, err := c.sessionRulesCollection()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = collection.UpdateId(id, bson.M{"$inc": bson.M{"hits": 1}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Namespaces are set from the comma separated LINKR_NAMESPACES. A link in a namespace lives at
+// /{namespace}/{shortUrl}, and its stored shortUrl includes the namespace, so a slug only has to be unique
+// within its namespace. Links outside any namespace are in the root namespace, as before.
+var Namespaces = make(map[string]bool)
+
+// initNamespaces reads LINKR_NAMESPACES, once the environment is loaded
+func initNamespaces() error {
+
+	for _, ns := range strings.Split(os.Getenv("LINKR_NAMESPACES"), ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" || Namespaces[ns] {
+			continue
+		}
+		err := validateShortUrl(ns)
+		if err != nil {
+			return fmt.Errorf("LINKR_NAMESPACES: %s", err)
+		}
+		Namespaces[ns] = true
+	}
+
+	return nil
+}
+
+// namespaceOf returns the namespace of a shortUrl or path, or "" for the root namespace
+func namespaceOf(shortUrl string) string {
+
+	i := strings.Index(shortUrl, "/")
+	if i < 0 || !Namespaces[shortUrl[:i]] {
+		return ""
+	}
+
+	return shortUrl[:i]
+}
+
+// setNamespace makes ld's namespace and shortUrl agree. A link sent with a namespace and a plain slug has the
+// namespace added to its shortUrl, and one sent with a shortUrl such as team/slug gets the namespace team.
+func setNamespace(ld *LinkDoc) error {
+
+	if ld.Namespace == "" {
+		ld.Namespace = namespaceOf(ld.ShortUrl)
+		return nil
+	}
+
+	if !Namespaces[ld.Namespace] {
+		return fmt.Errorf("namespace '%s' does not exist", ld.Namespace)
+	}
+	if ld.ShortUrl != "" && namespaceOf(ld.ShortUrl) != ld.Namespace {
+		ld.ShortUrl = ld.Namespace + "/" + ld.ShortUrl
+	}
+
+	return nil
+}
+
+// isNamespacePath is a mux matcher for requests whose first path segment is a namespace
+func isNamespacePath(r *http.Request, rm *mux.RouteMatch) bool {
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i]
+	}
+
+	return Namespaces[path]
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// withNamespaces runs fn with only the given namespaces set up
+func withNamespaces(fn func(), namespaces ...string) {
+
+	defer func(ns map[string]bool) { Namespaces = ns }(Namespaces)
+	Namespaces = make(map[string]bool)
+	for _, ns := range namespaces {
+		Namespaces[ns] = true
+	}
+
+	fn()
+}
+
+func TestInitNamespaces(t *testing.T) {
+
+	defer os.Setenv("LINKR_NAMESPACES", os.Getenv("LINKR_NAMESPACES"))
+	for _, c := range []struct {
+		env  string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"team", "team", true},
+		{" team, ops ,,team", "ops,team", true},
+		{"team,a b", "", false},
+	} {
+		withNamespaces(func() {
+			os.Setenv("LINKR_NAMESPACES", c.env)
+			err := initNamespaces()
+			var got []string
+			for ns := range Namespaces {
+				got = append(got, ns)
+			}
+			sort.Strings(got)
+			if (err == nil) != c.ok || (c.ok && strings.Join(got, ",") != c.want) {
+				t.Errorf("%q: %v, %v, want %s", c.env, got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestSetNamespace(t *testing.T) {
+
+	withNamespaces(func() {
+		for _, c := range []struct {
+			ld                  LinkDoc
+			shortUrl, namespace string
+			ok                  bool
+		}{
+			{LinkDoc{ShortUrl: "x"}, "x", "", true},
+			{LinkDoc{ShortUrl: "team/x"}, "team/x", "team", true},
+			{LinkDoc{ShortUrl: "docs/x"}, "docs/x", "", true},
+			{LinkDoc{ShortUrl: "x", Namespace: "team"}, "team/x", "team", true},
+			{LinkDoc{ShortUrl: "team/x", Namespace: "team"}, "team/x", "team", true},
+			{LinkDoc{ShortUrl: "ops/x", Namespace: "team"}, "team/ops/x", "team", true},
+			{LinkDoc{Namespace: "team"}, "", "team", true},
+			{LinkDoc{ShortUrl: "x", Namespace: "nope"}, "", "", false},
+		} {
+			ld := c.ld
+			err := setNamespace(&ld)
+			if (err == nil) != c.ok || (c.ok && (ld.ShortUrl != c.shortUrl || ld.Namespace != c.namespace)) {
+				t.Errorf("%+v: %q in %q, %v", c.ld, ld.ShortUrl, ld.Namespace, err)
+			}
+		}
+	}, "team", "ops")
+}
+
+func TestNamespaces(t *testing.T) {
+
+	withNamespaces(func() {
+		withStores(t, func(t *testing.T) {
+
+			for _, c := range []struct {
+				body     string
+				status   int
+				location string
+			}{
+				{`{"namespace": "team", "shortUrl": "x", "longUrl": "https://example.org/team"}`,
+					http.StatusCreated, "/api/links/team/x"},
+				{`{"shortUrl": "x", "longUrl": "https://example.org/root"}`, http.StatusCreated, "/api/links/x"},
+				{`{"shortUrl": "team/y", "longUrl": "https://example.org/y"}`, http.StatusCreated, "/api/links/team/y"},
+				{`{"namespace": "team", "shortUrl": "x", "longUrl": "https://example.org/again"}`, http.StatusConflict, ""},
+				{`{"namespace": "nope", "shortUrl": "x", "longUrl": "https://example.org/"}`, http.StatusBadRequest, ""},
+				{`{"shortUrl": "team", "longUrl": "https://example.org/"}`, http.StatusBadRequest, ""},
+				{`{"namespace": "team", "shortUrl": "a b", "longUrl": "https://example.org/"}`, http.StatusBadRequest, ""},
+			} {
+				w := serve("POST", "/api/links", c.body)
+				if w.Code != c.status || w.Header().Get("Location") != c.location {
+					t.Errorf("%s: status %v at %q, want %v at %q", c.body, w.Code, w.Header().Get("Location"), c.status,
+						c.location)
+				}
+			}
+
+			// A generated slug goes under the namespace too, passing over one already taken there
+			defer func(g ShortCodeGenerator) { ShortCodes = g }(ShortCodes)
+			ShortCodes = &listGenerator{codes: []string{"x", "gen"}}
+			w := serve("POST", "/api/links", `{"namespace": "team", "longUrl": "https://example.org/gen"}`)
+			if w.Code != http.StatusCreated || w.Header().Get("Location") != "/api/links/team/gen" {
+				t.Errorf("generated: status %v at %q", w.Code, w.Header().Get("Location"))
+			}
+
+			for _, c := range []struct {
+				path, want string
+			}{
+				{"/team/x", "https://example.org/team"},
+				{"/x", "https://example.org/root"},
+				{"/team/y", "https://example.org/y"},
+				{"/team", "/team/popular.html"},
+			} {
+				if w := serve("GET", c.path, ""); w.Header().Get("Location") != c.want {
+					t.Errorf("%s: %v to %q, want %q", c.path, w.Code, w.Header().Get("Location"), c.want)
+				}
+			}
+			waitForClicks(t, "team/x", 1)
+			waitForClicks(t, "team/y", 1)
+			waitForClicks(t, "x", 1)
+
+			// Each namespace has its own popular links, the root has them all
+			for path, want := range map[string]string{
+				"/team/popular.json": "team/x,team/y",
+				"/popular.json":      "team/x,team/y,x",
+			} {
+				var lds []LinkDoc
+				json.NewDecoder(serve("GET", path, "").Body).Decode(&lds)
+				var got []string
+				for _, ld := range lds {
+					got = append(got, ld.ShortUrl)
+				}
+				sort.Strings(got)
+				if strings.Join(got, ",") != want {
+					t.Errorf("%s: %v, want %s", path, got, want)
+				}
+			}
+		})
+	}, "team")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	passwordIterations    = 100000
+	passwordSaltLength    = 16
+	passwordHashPrefix    = "pbkdf2-sha256"
+	passwordCookiePrefix  = "linkr_pw_"
+	defaultPasswordCookie = time.Hour
+
+	// maxPasswordFailures wrong passwords from one IP within passwordFailureWindow locks that IP out until the window ends
+	maxPasswordFailures   = 5
+	passwordFailureWindow = 15 * time.Minute
+)
+
+// ErrEmptyPassword is returned when a link is given an empty password rather than null to clear it
+var ErrEmptyPassword = errors.New("password must not be empty, send null to remove it")
+
+// cookieSecret signs the cookies that remember a correct password. It comes from LINKR_COOKIE_SECRET, or is
+// random if that isn't set, in which case visitors have to enter passwords again after a restart.
+var cookieSecret []byte
+
+// passwordFailures counts wrong passwords per IP
+var passwordFailures = newFailureLimiter(maxPasswordFailures, passwordFailureWindow)
+
+// initCookieSecret sets cookieSecret, once the environment is loaded
+func initCookieSecret() {
+
+	cookieSecret = []byte(os.Getenv("LINKR_COOKIE_SECRET"))
+	if len(cookieSecret) == 0 {
+		cookieSecret = make([]byte, 32)
+		_, err := rand.Read(cookieSecret)
+		if err != nil {
+			log.Fatalln("Could not generate a cookie secret:", err)
+		}
+	}
+}
+
+// OptionalPassword is a password in a request body, which may be left out, null (to remove it) or a new password
+type OptionalPassword struct {
+	Set   bool
+	Value *string
+}
+
+func (p *OptionalPassword) UnmarshalJSON(b []byte) error {
+
+	p.Set = true
+
+	return json.Unmarshal(b, &p.Value)
+}
+
+// HashPassword returns a salted PBKDF2 hash of the password, in the form
+// pbkdf2-sha256$iterations$salt$hash
+func HashPassword(password string) (string, error) {
+
+	salt := make([]byte, passwordSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(password), salt, passwordIterations, sha256.Size, sha256.New)
+
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashPrefix, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches a hash from HashPassword
+func CheckPassword(password, hashed string) bool {
+
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 || parts[0] != passwordHashPrefix {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	got := pbkdf2([]byte(password), salt, iter, len(want), sha256.New)
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2 derives a key as per RFC 8018
+func pbkdf2(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		buf[0] = byte(block >> 24)
+		buf[1] = byte(block >> 16)
+		buf[2] = byte(block >> 8)
+		buf[3] = byte(block)
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
+
+// passwordGate deals with a visit to a password protected link. It returns true if the visitor may be
+// redirected, otherwise it has already responded, with the password form or, once the right password is given,
+// a 303 back to the link. Redirecting straight to the destination would pass the form, password and all, on to
+// it if the link uses a 307 or 308.
+func passwordGate(w http.ResponseWriter, r *http.Request, ld LinkDoc) bool {
+
+	if hasPasswordCookie(r, ld) {
+		return true
+	}
+
+	pageData := make(map[string]interface{})
+	pageData["ShortUrl"] = ld.ShortUrl
+	pageData["Title"] = ld.Title
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusUnauthorized)
+		tpl.ExecuteTemplate(w, "password", pageData)
+		return false
+	}
+
+	ip := clientIP(r)
+	if passwordFailures.Blocked(ip) {
+		fmt.Println("too many password attempts from", ip)
+		pageData["Message"] = "Too many incorrect passwords, please try again later."
+		w.Header().Set("Retry-After", strconv.Itoa(int(passwordFailureWindow/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		tpl.ExecuteTemplate(w, "password", pageData)
+		return false
+	}
+
+	if !CheckPassword(r.PostFormValue("password"), ld.PasswordHash) {
+		fmt.Println("incorrect password")
+		passwordFailures.Fail(ip)
+		pageData["Message"] = "Incorrect password, please try again."
+		w.WriteHeader(http.StatusUnauthorized)
+		tpl.ExecuteTemplate(w, "password", pageData)
+		return false
+	}
+
+	setPasswordCookie(w, r, ld)
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+
+	return false
+}
+
+// setPasswordCookie remembers that the visitor knows the password for ld
+func setPasswordCookie(w http.ResponseWriter, r *http.Request, ld LinkDoc) {
+
+	expires := time.Now().Add(envDuration("LINKR_PASSWORD_COOKIE_TTL", defaultPasswordCookie))
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName(passwordCookiePrefix, ld.ShortUrl),
+		Value:    exp + "." + passwordCookieSig(ld, exp),
+		Path:     "/" + ld.ShortUrl,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+	})
+}
+
+// hasPasswordCookie checks for an unexpired cookie from setPasswordCookie. Changing the
+// password invalidates existing cookies as the hash is part of the signature.
+func hasPasswordCookie(r *http.Request, ld LinkDoc) bool {
+
+	c, err := r.Cookie(cookieName(passwordCookiePrefix, ld.ShortUrl))
+	if err != nil {
+		return false
+	}
+
+	i := strings.Index(c.Value, ".")
+	if i < 0 {
+		return false
+	}
+	exp, sig := c.Value[:i], c.Value[i+1:]
+
+	t, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > t {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(passwordCookieSig(ld, exp)))
+}
+
+// cookieName is the name of a per link cookie. A slash isn't allowed in a cookie name, and every other character
+// that could stand in for it can be in a shortUrl too, so the shortUrl is base64url encoded, which can't collide.
+func cookieName(prefix, shortUrl string) string {
+
+	return prefix + base64.RawURLEncoding.EncodeToString([]byte(shortUrl))
+}
+
+func passwordCookieSig(ld LinkDoc, exp string) string {
+
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte(ld.ShortUrl + "|" + exp + "|" + ld.PasswordHash))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// failureLimiter counts failures per key in a fixed window
+type failureLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string]failureCount
+}
+
+type failureCount struct {
+	n     int
+	start time.Time
+}
+
+func newFailureLimiter(max int, window time.Duration) *failureLimiter {
+
+	return &failureLimiter{max: max, window: window, failures: make(map[string]failureCount)}
+}
+
+// Blocked reports whether key has used up its failures for the current window
+func (l *failureLimiter) Blocked(key string) bool {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok {
+		return false
+	}
+	if time.Since(f.start) > l.window {
+		delete(l.failures, key)
+		return false
+	}
+
+	return f.n >= l.max
+}
+
+// Fail records a failure for key
+func (l *failureLimiter) Fail(key string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Tidy up while we are here so the map doesn't grow forever
+	now := time.Now()
+	for k, f := range l.failures {
+		if now.Sub(f.start) > l.window {
+			delete(l.failures, k)
+		}
+	}
+
+	f, ok := l.failures[key]
+	if !ok {
+		f = failureCount{start: now}
+	}
+	f.n++
+	l.failures[key] = f
+}
+
+// clientIP is the address of the visitor. Behind Heroku's router the connection comes from the router,
+// which adds the address that connected to it at the end of X-Forwarded-For. Anything before that was sent by
+// the client, and could be made up, so only the last address is used.
+func clientIP(r *http.Request) string {
+
+	if xff := strings.Join(r.Header["X-Forwarded-For"], ","); xff != "" {
+		ips := strings.Split(xff, ",")
+		ip := strings.TrimSpace(ips[len(ips)-1])
+		if net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+
+	// RFC 6070, less the one with 16777216 iterations, then PBKDF2-HMAC-SHA256 from RFC 7914 section 11
+	for _, c := range []struct {
+		password, salt string
+		iter, keyLen   int
+		sha256         bool
+		want           string
+	}{
+		{"password", "salt", 1, 20, false, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, 20, false, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, 20, false, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 25, false,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, 16, false, "56fa6aa75548099dcc37d7f03425e0c3"},
+		{"passwd", "salt", 1, 64, true, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	} {
+		h := sha1.New
+		if c.sha256 {
+			h = sha256.New
+		}
+		got := hex.EncodeToString(pbkdf2([]byte(c.password), []byte(c.salt), c.iter, c.keyLen, h))
+		if got != c.want {
+			t.Errorf("%q, %q, %d: %s, want %s", c.password, c.salt, c.iter, got, c.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+
+	hashed, err := HashPassword("open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, passwordHashPrefix+"$") {
+		t.Errorf("hash %s", hashed)
+	}
+	if !CheckPassword("open sesame", hashed) {
+		t.Error("right password refused")
+	}
+	if CheckPassword("open sesame!", hashed) {
+		t.Error("wrong password accepted")
+	}
+
+	// Another hash of the same password has its own salt
+	again, _ := HashPassword("open sesame")
+	if again == hashed {
+		t.Error("two hashes are the same")
+	}
+
+	for _, bad := range []string{
+		"",
+		"open sesame",
+		strings.Replace(hashed, passwordHashPrefix, "pbkdf2-sha1", 1),
+		passwordHashPrefix + "$0$c2FsdA$aGFzaA",
+		passwordHashPrefix + "$x$c2FsdA$aGFzaA",
+		passwordHashPrefix + "$1$!!$aGFzaA",
+	} {
+		if CheckPassword("open sesame", bad) {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+
+	for _, c := range []struct {
+		xff  []string
+		want string
+	}{
+		{nil, "192.0.2.1"},
+		{[]string{"203.0.113.7"}, "203.0.113.7"},
+		{[]string{"10.0.0.1, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"10.0.0.1", "198.51.100.2, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"203.0.113.7, 2001:db8::1"}, "2001:db8::1"},
+		{[]string{"203.0.113.7, unknown"}, "192.0.2.1"},
+	} {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header["X-Forwarded-For"] = c.xff
+		if got := clientIP(r); got != c.want {
+			t.Errorf("%q: %s, want %s", c.xff, got, c.want)
+		}
+	}
+}
+
+func TestPasswordFormRedirect(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		w := serve("POST", "/api/links", `{"shortUrl": "pw", "longUrl": "https://example.org/api", "redirectType": 307,
+			"password": "secret"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: status %v, %s", w.Code, w.Body)
+		}
+
+		w = serve("GET", "/pw?a=1", "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET without the password: status %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+
+		// The right password goes back to the link with a 303, so the browser follows it with a GET and the form
+		// isn't sent on to the destination as a 307 would
+		r := httptest.NewRequest("POST", "/pw?a=1", strings.NewReader("password=secret"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		NewRouter().ServeHTTP(w, r)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/pw?a=1" {
+			t.Fatalf("POST the password: %v to %q, want 303 to /pw?a=1", w.Code, w.Header().Get("Location"))
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("cookies %v, want one", cookies)
+		}
+
+		// With the cookie the link redirects as usual
+		r = httptest.NewRequest("GET", "/pw?a=1", nil)
+		r.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		NewRouter().ServeHTTP(w, r)
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://example.org/api" {
+			t.Errorf("GET with the cookie: %v to %q", w.Code, w.Header().Get("Location"))
+		}
+		waitForClicks(t, "pw", 1)
+
+		// A wrong password gets the form again
+		r = httptest.NewRequest("POST", "/pw", strings.NewReader("password=wrong"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		NewRouter().ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("Location") != "" {
+			t.Errorf("POST a wrong password: %v to %q", w.Code, w.Header().Get("Location"))
+		}
+	})
+}
+
+func TestCookieName(t *testing.T) {
+
+	seen := make(map[string]string)
+	for _, shortUrl := range []string{"a.b", "a/b", "a_b", "a-b", "ab", "team/old/page.html", "team.old/page/html"} {
+		name := cookieName(passwordCookiePrefix, shortUrl)
+		if other, ok := seen[name]; ok {
+			t.Errorf("%s and %s are both %s", shortUrl, other, name)
+		}
+		seen[name] = shortUrl
+
+		// A cookie that can't be sent back is dropped, so the name must survive a round trip
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: name, Value: "x"})
+		if c, err := r.Cookie(name); err != nil || c.Value != "x" {
+			t.Errorf("%s: cookie %s didn't come back", shortUrl, name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// findLinkForPath looks up the link for a request path, without the leading slash. A link whose shortUrl is the
+// whole path wins, otherwise the prefix link with the longest shortUrl that the path starts with, segment by
+// segment, so docs/api beats docs for docs/api/auth. It returns ErrNotFound if neither exists.
+func findLinkForPath(path string) (LinkDoc, error) {
+
+	ld, err := Store.FindLink(path)
+	if err != ErrNotFound {
+		return ld, err
+	}
+
+	for p := path; ; {
+		i := strings.LastIndex(p, "/")
+		if i <= 0 {
+			return LinkDoc{}, ErrNotFound
+		}
+		p = p[:i]
+
+		ld, err = Store.FindLink(p)
+		if err == ErrNotFound || (err == nil && !ld.Prefix) {
+			continue
+		}
+
+		return ld, err
+	}
+}
+
+// orForward wraps the handler for one of linkr's own paths under a link, such as /{shortUrl}/stats.json, so that
+// when there is no link with that shortUrl the whole path is redirected instead. That way /docs/openapi.json still
+// goes through the prefix link docs.
+func orForward(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, err := Store.FindLink(mux.Vars(r)["shortUrl"])
+		if err == ErrNotFound {
+			redirectPath(w, r, strings.TrimPrefix(r.URL.Path, "/"))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// forwardPath appends the part of the request path after a prefix link's shortUrl to dest, before any query
+// string or fragment. rest is as escaped in the request and starts with a slash if there is any.
+func forwardPath(dest, rest string) string {
+
+	if rest == "" {
+		return dest
+	}
+
+	base, tail := dest, ""
+	if i := strings.IndexAny(base, "?#"); i >= 0 {
+		base, tail = base[:i], base[i:]
+	}
+
+	return strings.TrimSuffix(base, "/") + rest + tail
+}
+
+// validPathSegment matches a segment of a link's path, which unlike a generated slug may have dots, eg about.html
+var validPathSegment = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// linkrPages are linkr's own pages that a link can't have the path of, as their routes come first. Any path ending
+// in .json is also taken, for the link JSON, as are stats.html and the like under a link.
+var linkrPages = map[string]bool{
+	"popular.html":  true,
+	"trending.html": true,
+	"latest.html":   true,
+	"broken.html":   true,
+}
+
+// validatePath checks a link's shortUrl, which may be a path of several segments, eg docs/api or old/about.html, so
+// that redirects from an old site can be kept as they were.
+func validatePath(shortUrl string) error {
+
+	if len(shortUrl) == 0 || len(shortUrl) > maxShortUrlLength {
+		return fmt.Errorf("shortUrl must be between 1 and %v characters", maxShortUrlLength)
+	}
+
+	segments := strings.Split(shortUrl, "/")
+	for _, s := range segments {
+		if s == "." || s == ".." || !validPathSegment.MatchString(s) {
+			return fmt.Errorf("shortUrl may only contain letters, numbers, '-', '_' and '.' between slashes")
+		}
+	}
+
+	// Only the first segment can clash with linkr's own paths, and the last with the pages under a link
+	first, last := segments[0], segments[len(segments)-1]
+	if reservedShortUrls[strings.ToLower(first)] || Namespaces[first] || (len(segments) == 1 && linkrPages[first]) {
+		return fmt.Errorf("shortUrl '%s' is reserved", shortUrl)
+	}
+	if strings.HasSuffix(shortUrl, ".json") || (len(segments) > 1 && last == "stats.html") {
+		return fmt.Errorf("shortUrl '%s' is the path of one of linkr's own pages", shortUrl)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFindLinkForPath(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		for _, ld := range []LinkDoc{
+			{ShortUrl: "docs", LongUrl: "https://docs.example.org/", Prefix: true},
+			{ShortUrl: "docs/api", LongUrl: "https://api.example.org/docs", Prefix: true},
+			{ShortUrl: "docs/api/auth/login", LongUrl: "https://example.org/login"},
+			{ShortUrl: "blog", LongUrl: "https://example.org/blog"},
+		} {
+			if err := Store.AddLink(ld); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, c := range []struct {
+			path, want string
+		}{
+			{"docs", "docs"},
+			{"docs/intro", "docs"},
+			{"docs/api", "docs/api"},
+			{"docs/api/auth", "docs/api"},
+			{"docs/api/auth/login", "docs/api/auth/login"},
+			{"docs/api/auth/login/again", "docs/api"},
+			{"docs/apis", "docs"},
+			{"docsapi", ""},
+			{"blog/post", ""},
+			{"nothing/here", ""},
+		} {
+			ld, err := findLinkForPath(c.path)
+			if c.want == "" {
+				if err != ErrNotFound {
+					t.Errorf("%s: %s, %v, want not found", c.path, ld.ShortUrl, err)
+				}
+			} else if err != nil || ld.ShortUrl != c.want {
+				t.Errorf("%s: %s, %v, want %s", c.path, ld.ShortUrl, err, c.want)
+			}
+		}
+	})
+}
+
+func TestForwardPath(t *testing.T) {
+
+	for _, c := range []struct {
+		dest, rest, want string
+	}{
+		{"https://example.org/docs", "", "https://example.org/docs"},
+		{"https://example.org/docs", "/api", "https://example.org/docs/api"},
+		{"https://example.org/docs/", "/api", "https://example.org/docs/api"},
+		{"https://example.org", "/api", "https://example.org/api"},
+		{"https://example.org/docs?v=2#top", "/api", "https://example.org/docs/api?v=2#top"},
+		{"https://example.org/docs#top", "/a%20b", "https://example.org/docs/a%20b#top"},
+		{"https://example.org/docs", "/", "https://example.org/docs/"},
+	} {
+		if got := forwardPath(c.dest, c.rest); got != c.want {
+			t.Errorf("%s + %s: %s, want %s", c.dest, c.rest, got, c.want)
+		}
+	}
+}
+
+func TestPrefixRedirects(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		w := serve("POST", "/api/links", `{"shortUrl": "docs", "longUrl": "https://docs.example.org/v2?lang=en", "prefix": true}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: status %v, %s", w.Code, w.Body)
+		}
+
+		for _, c := range []struct {
+			path, want string
+		}{
+			{"/docs", "https://docs.example.org/v2?lang=en"},
+			{"/docs/api/auth?x=1", "https://docs.example.org/v2/api/auth?lang=en&x=1"},
+			{"/docs/a%2Fb", "https://docs.example.org/v2/a%2Fb?lang=en"},
+
+			// linkr's own paths under a link that doesn't exist go on through the prefix link
+			{"/docs/openapi.json", "https://docs.example.org/v2/openapi.json?lang=en"},
+			{"/docs/intro/stats.html", "https://docs.example.org/v2/intro/stats.html?lang=en"},
+		} {
+			if w := serve("GET", c.path, ""); w.Header().Get("Location") != c.want {
+				t.Errorf("%s: %v to %q, want %q", c.path, w.Code, w.Header().Get("Location"), c.want)
+			}
+		}
+		waitForClicks(t, "docs", 5)
+
+		// And the link's own JSON is still its own
+		if w := serve("GET", "/docs.json", ""); w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+			t.Errorf("/docs.json: status %v to %q", w.Code, w.Header().Get("Location"))
+		}
+	})
+}
+
+func TestValidatePath(t *testing.T) {
+
+	for _, c := range []struct {
+		shortUrl string
+		ok       bool
+	}{
+		{"docs", true},
+		{"docs/api", true},
+		{"old/about.html", true},
+		{"a/stats.html.bak", true},
+		{"", false},
+		{"docs/", false},
+		{"/docs", false},
+		{"docs//api", false},
+		{"docs/../api", false},
+		{"docs/a b", false},
+		{"api/docs", false},
+		{"popular.html", false},
+		{"old/popular.html", true},
+		{"docs/api.json", false},
+		{"docs/stats.html", false},
+	} {
+		if err := validatePath(c.shortUrl); (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.shortUrl, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UTMParams are added to the destination as utm_source, utm_medium and so on
+type UTMParams struct {
+	Source   string `json:"source,omitempty" bson:"source,omitempty"`
+	Medium   string `json:"medium,omitempty" bson:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty" bson:"campaign,omitempty"`
+	Term     string `json:"term,omitempty" bson:"term,omitempty"`
+	Content  string `json:"content,omitempty" bson:"content,omitempty"`
+}
+
+// queryParam is one name=value pair of a query string. raw is kept so that parameters already in a url go
+// back exactly as they were.
+type queryParam struct {
+	name string
+	raw  string
+}
+
+func newQueryParam(name, value string) queryParam {
+
+	return queryParam{name: name, raw: url.QueryEscape(name) + "=" + url.QueryEscape(value)}
+}
+
+// redirectURL adds to dest the query parameters that the link's settings call for: those the visitor arrived
+// with if passQuery is set or it is a prefix link, minus any in stripParams, plus the utm parameters.
+// Parameters already in dest stay in place unless replaced, and the fragment is kept on the end.
+func redirectURL(dest string, r *http.Request, ld LinkDoc) string {
+
+	passQuery := ld.PassQuery || ld.Prefix
+	if !passQuery && ld.UTM == nil && len(ld.StripParams) == 0 {
+		return dest
+	}
+
+	base, fragment := dest, ""
+	if i := strings.Index(base, "#"); i >= 0 {
+		base, fragment = base[:i], base[i:]
+	}
+	base, rawQuery := base, ""
+	if i := strings.Index(base, "?"); i >= 0 {
+		base, rawQuery = base[:i], base[i+1:]
+	}
+	params := parseQuery(rawQuery)
+
+	// The visitor's values replace any for the same name
+	if passQuery {
+		incoming := parseQuery(r.URL.RawQuery)
+		names := make(map[string]bool)
+		for _, p := range incoming {
+			names[p.name] = true
+		}
+		params = filterParams(params, func(p queryParam) bool { return !names[p.name] })
+		params = append(params, incoming...)
+	}
+
+	if len(ld.StripParams) > 0 {
+		params = filterParams(params, func(p queryParam) bool { return !stripParam(p.name, ld.StripParams) })
+	}
+
+	if ld.UTM != nil {
+		for _, u := range []struct{ name, value string }{
+			{"utm_source", ld.UTM.Source},
+			{"utm_medium", ld.UTM.Medium},
+			{"utm_campaign", ld.UTM.Campaign},
+			{"utm_term", ld.UTM.Term},
+			{"utm_content", ld.UTM.Content},
+		} {
+			if u.value == "" {
+				continue
+			}
+			params = filterParams(params, func(p queryParam) bool { return p.name != u.name })
+			params = append(params, newQueryParam(u.name, u.value))
+		}
+	}
+
+	raws := make([]string, len(params))
+	for i, p := range params {
+		raws[i] = p.raw
+	}
+	if len(raws) > 0 {
+		base += "?" + strings.Join(raws, "&")
+	}
+
+	return base + fragment
+}
+
+// parseQuery splits a raw query string into its parameters, in order
+func parseQuery(rawQuery string) []queryParam {
+
+	var params []queryParam
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		name := raw
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		params = append(params, queryParam{name: name, raw: raw})
+	}
+
+	return params
+}
+
+func filterParams(params []queryParam, keep func(queryParam) bool) []queryParam {
+
+	var kept []queryParam
+	for _, p := range params {
+		if keep(p) {
+			kept = append(kept, p)
+		}
+	}
+
+	return kept
+}
+
+// stripParam reports whether name is in the strip list, where an entry ending in * matches any name it starts
+func stripParam(name string, strip []string) bool {
+
+	for _, s := range strip {
+		if strings.HasSuffix(s, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(s, "*")) {
+				return true
+			}
+		} else if name == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateStripParams checks the strip list has no empty entries, which would be mistakes
+func validateStripParams(strip []string) error {
+
+	for i, s := range strip {
+		if s == "" || s == "*" {
+			return fmt.Errorf("stripParams[%d] must be a parameter name, or the start of one followed by *", i)
+		}
+	}
+
+	return nil
+}
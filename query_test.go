@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectURL(t *testing.T) {
+
+	utm := &UTMParams{Source: "newsletter", Medium: "email", Campaign: "spring sale"}
+	for _, c := range []struct {
+		name, dest, path string
+		ld               LinkDoc
+		want             string
+	}{
+		{"nothing to do", "https://example.org/a?x=1", "/a?y=2", LinkDoc{}, "https://example.org/a?x=1"},
+		{"passed on", "https://example.org/a", "/a?y=2&z=%2F", LinkDoc{PassQuery: true},
+			"https://example.org/a?y=2&z=%2F"},
+		{"added to the link's own", "https://example.org/a?x=1#top", "/a?y=2", LinkDoc{PassQuery: true},
+			"https://example.org/a?x=1&y=2#top"},
+		{"the visitor's win", "https://example.org/a?x=1&y=1&y=3", "/a?y=2", LinkDoc{PassQuery: true},
+			"https://example.org/a?x=1&y=2"},
+		{"always for a prefix link", "https://example.org/a", "/a?y=2", LinkDoc{Prefix: true},
+			"https://example.org/a?y=2"},
+		{"nothing to pass on", "https://example.org/a", "/a", LinkDoc{PassQuery: true}, "https://example.org/a"},
+		{"repeated names kept", "https://example.org/a", "/a?tag=a&tag=b", LinkDoc{PassQuery: true},
+			"https://example.org/a?tag=a&tag=b"},
+		{"utm", "https://example.org/a?x=1#top", "/a", LinkDoc{UTM: utm},
+			"https://example.org/a?x=1&utm_source=newsletter&utm_medium=email&utm_campaign=spring+sale#top"},
+		{"utm replaces the visitor's", "https://example.org/a", "/a?utm_source=twitter&utm_term=x",
+			LinkDoc{PassQuery: true, UTM: &UTMParams{Source: "newsletter"}},
+			"https://example.org/a?utm_term=x&utm_source=newsletter"},
+		{"strip", "https://example.org/a?ref=x&id=1", "/a?fbclid=1&utm_source=x&utm_medium=y&page=2",
+			LinkDoc{PassQuery: true, StripParams: []string{"fbclid", "utm_*", "ref"}},
+			"https://example.org/a?id=1&page=2"},
+		{"strip only whole names", "https://example.org/a?reference=1", "/a", LinkDoc{StripParams: []string{"ref"}},
+			"https://example.org/a?reference=1"},
+		{"strip then utm", "https://example.org/a", "/a?utm_source=x",
+			LinkDoc{PassQuery: true, StripParams: []string{"utm_*"}, UTM: &UTMParams{Medium: "email"}},
+			"https://example.org/a?utm_medium=email"},
+		{"all stripped", "https://example.org/a?ref=1#top", "/a", LinkDoc{StripParams: []string{"ref"}},
+			"https://example.org/a#top"},
+		{"escaped names", "https://example.org/a?caf%C3%A9=1", "/a?caf%C3%A9=2", LinkDoc{PassQuery: true},
+			"https://example.org/a?caf%C3%A9=2"},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if got := redirectURL(c.dest, r, c.ld); got != c.want {
+			t.Errorf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidateStripParams(t *testing.T) {
+
+	for _, c := range []struct {
+		strip []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"fbclid", "utm_*"}, true},
+		{[]string{"fbclid", ""}, false},
+		{[]string{"*"}, false},
+	} {
+		if err := validateStripParams(c.strip); (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.strip, err)
+		}
+	}
+}
@@ -10,24 +10,59 @@ import (
 
 func Start() {
 
+	// Heroku dyanmically assigns port so..
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	log.Printf("Listening on port %s\n", port)
+	log.Fatal(http.ListenAndServe(":"+port, NewRouter()))
+}
+
+// NewRouter sets up linkr's routes, wrapped in the CORS handler
+func NewRouter() http.Handler {
+
 	r := mux.NewRouter()
 	r.Methods("GET").Path("/").HandlerFunc(IndexHandler)
 	r.Methods("GET").Path("/popular.html").HandlerFunc(PopularHTMLHandler)
 	r.Methods("GET").Path("/popular.json").HandlerFunc(PopularJSONHandler)
+	r.Methods("GET").Path("/trending.html").HandlerFunc(TrendingHTMLHandler)
+	r.Methods("GET").Path("/trending.json").HandlerFunc(TrendingJSONHandler)
 	r.Methods("GET").Path("/latest.html").HandlerFunc(LatestHTMLHandler)
 	r.Methods("GET").Path("/broken.json").HandlerFunc(BrokenJSONHandler)
-	r.Methods("GET").Path("/{shortUrl}.json").HandlerFunc(JSONHandler)
-	r.Methods("GET").Path("/{shortUrl}").HandlerFunc(RedirectHandler)
+	r.Methods("GET").Path("/broken.html").HandlerFunc(BrokenHTMLHandler)
 
-	// Heroku dyanmically assigns port so..
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	// Each namespace has its own listings
+	r.Methods("GET").Path("/{namespace}").MatcherFunc(isNamespacePath).HandlerFunc(IndexHandler)
+	r.Methods("GET").Path("/{namespace}/popular.html").MatcherFunc(isNamespacePath).HandlerFunc(PopularHTMLHandler)
+	r.Methods("GET").Path("/{namespace}/popular.json").MatcherFunc(isNamespacePath).HandlerFunc(PopularJSONHandler)
+	r.Methods("GET").Path("/{namespace}/latest.html").MatcherFunc(isNamespacePath).HandlerFunc(LatestHTMLHandler)
 
-	//... wrap r with simple CORS handler?
-	h := cors.Default().Handler(r)
+	// Link management API, requires LINKR_API_KEY
+	r.Methods("POST").Path("/api/links").HandlerFunc(APIAuth(CreateLinkHandler))
+	r.Methods("PATCH").Path("/api/links/{shortUrl:.+}").HandlerFunc(APIAuth(UpdateLinkHandler))
+	r.Methods("DELETE").Path("/api/links/{shortUrl:.+}").HandlerFunc(APIAuth(DeleteLinkHandler))
+	r.Methods("POST").Path("/api/links/{shortUrl:.+}/accept-moved").HandlerFunc(APIAuth(AcceptMovedHandler))
+	r.Methods("GET").Path("/api/moved").HandlerFunc(APIAuth(MovedJSONHandler))
+	r.Methods("GET").Path("/api/rules").HandlerFunc(APIAuth(RulesJSONHandler))
+	r.Methods("PUT").Path("/api/rules").HandlerFunc(APIAuth(SetRulesHandler))
+	r.Methods("GET").Path("/api/rules/test").HandlerFunc(APIAuth(TestRulesHandler))
 
-	log.Printf("Listening on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, h))
+	// shortUrl may have slashes in it, for prefix links such as docs/api, so .json has to come after the rest.
+	// If there's no such link the path may be under a prefix link, so is redirected.
+	r.Methods("GET").Path("/{shortUrl:.+}/checks.json").HandlerFunc(orForward(ChecksJSONHandler))
+	r.Methods("GET").Path("/{shortUrl:.+}/stats.json").HandlerFunc(orForward(StatsJSONHandler))
+	r.Methods("GET").Path("/{shortUrl:.+}/stats.html").HandlerFunc(orForward(StatsHTMLHandler))
+	r.Methods("GET").Path("/{shortUrl:.+}.json").HandlerFunc(orForward(JSONHandler))
+
+	// Any method, so that a 307 or 308 link can pass on a POST or PUT. POST is also the password form.
+	// The whole path is matched, as it may be under a prefix link.
+	r.Methods("GET", "HEAD", "POST", "PUT", "PATCH", "DELETE").Path("/{shortUrl:.+}").HandlerFunc(RedirectHandler)
+
+	//... wrap r with simple CORS handler, allowing the API methods and auth header
+	return cors.New(cors.Options{
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	}).Handler(r)
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ruleCacheTTL is how long the compiled rules are kept before they are read from the store again, so that
+// rules changed by another instance are picked up
+const ruleCacheTTL = time.Minute
+
+// compiledRule is a RuleDoc with its pattern ready to match
+type compiledRule struct {
+	RuleDoc
+	re *regexp.Regexp
+}
+
+// ruleCache holds the compiled rules, as not found paths would otherwise have to read and compile them all
+var ruleCache struct {
+	sync.Mutex
+	rules    []compiledRule
+	loadedAt time.Time
+}
+
+// loadRules returns the compiled rules, reading them from the store if the cache is stale
+func loadRules() ([]compiledRule, error) {
+
+	ruleCache.Lock()
+	defer ruleCache.Unlock()
+
+	if !ruleCache.loadedAt.IsZero() && time.Since(ruleCache.loadedAt) < ruleCacheTTL {
+		return ruleCache.rules, nil
+	}
+
+	rules, err := Store.Rules()
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, rd := range rules {
+		re, err := regexp.Compile(rd.Pattern)
+		if err != nil {
+			// Saved rules are validated, so this was put in the store some other way
+			log.Printf("Skipping rule %s: %s", rd.ID.Hex(), err)
+			continue
+		}
+		compiled = append(compiled, compiledRule{RuleDoc: rd, re: re})
+	}
+	ruleCache.rules = compiled
+	ruleCache.loadedAt = time.Now()
+
+	return compiled, nil
+}
+
+// resetRules empties the cache, so the next lookup reads the rules from the store
+func resetRules() {
+
+	ruleCache.Lock()
+	defer ruleCache.Unlock()
+
+	ruleCache.rules = nil
+	ruleCache.loadedAt = time.Time{}
+}
+
+// matchRule finds the first rule that matches path, which includes the leading slash, and returns it with the
+// expanded destination. A rule whose destination isn't a valid url is passed over.
+func matchRule(path string) (rule RuleDoc, dest string, ok bool, err error) {
+
+	rules, err := loadRules()
+	if err != nil {
+		return rule, "", false, err
+	}
+
+	for _, cr := range rules {
+		m := cr.re.FindStringSubmatchIndex(path)
+		if m == nil {
+			continue
+		}
+		dest = string(cr.re.ExpandString(nil, cr.Template, path, m))
+		if validateLongUrl(dest) != nil {
+			log.Printf("Rule %s gave an invalid url for %s: %s", cr.ID.Hex(), path, dest)
+			continue
+		}
+		return cr.RuleDoc, dest, true, nil
+	}
+
+	return rule, "", false, nil
+}
+
+// ruleRedirect redirects the request if a rule matches path, counting and recording it like a click on a link,
+// which a HEAD isn't. It reports whether it did.
+func ruleRedirect(w http.ResponseWriter, r *http.Request, path string) bool {
+
+	rd, dest, ok, err := matchRule(path)
+	if err != nil {
+		log.Printf("Error loading rules: %s", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	fmt.Println("rule", rd.ID.Hex(), "-> ", dest)
+
+	if r.Method != "HEAD" {
+		go func() {
+			err := Store.IncrementRuleHits(rd.ID)
+			if err != nil {
+				fmt.Println("Error counting rule hit:", err)
+			}
+		}()
+
+		stats := newLinkStats(r, rd.ID)
+		stats.Path = path
+		go recordStats(stats)
+	}
+
+	http.Redirect(w, r, dest, DefaultRedirectType)
+
+	return true
+}
+
+// validateRule checks a rule's pattern compiles and its template is an http or https url
+func validateRule(rd RuleDoc) error {
+
+	if rd.Pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	_, err := regexp.Compile(rd.Pattern)
+	if err != nil {
+		return fmt.Errorf("pattern: %s", err)
+	}
+	if !strings.HasPrefix(rd.Template, "http://") && !strings.HasPrefix(rd.Template, "https://") {
+		return fmt.Errorf("template must start with http:// or https://")
+	}
+
+	return nil
+}
+
+// RulesJSONHandler lists the rules in the order they are tried
+func RulesJSONHandler(w http.ResponseWriter, r *http.Request) {
+
+	rules, err := Store.Rules()
+	if err != nil {
+		log.Printf("Error finding rules: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding rules"})
+		return
+	}
+	if rules == nil {
+		rules = []RuleDoc{}
+	}
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// SetRulesHandler replaces the rules with the JSON array in the body, which are tried in the order given.
+// A rule sent with the _id of an existing one keeps its hits and createdAt.
+func SetRulesHandler(w http.ResponseWriter, r *http.Request) {
+
+	var rules []RuleDoc
+	err := json.NewDecoder(r.Body).Decode(&rules)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"Could not decode request body: " + err.Error()})
+		return
+	}
+
+	old, err := Store.Rules()
+	if err != nil {
+		log.Printf("Error finding rules: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding rules"})
+		return
+	}
+	existing := make(map[bson.ObjectId]RuleDoc, len(old))
+	for _, rd := range old {
+		existing[rd.ID] = rd
+	}
+
+	now := time.Now()
+	seen := make(map[bson.ObjectId]bool, len(rules))
+	for i := range rules {
+		err = validateRule(rules[i])
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, APIResponse{fmt.Sprintf("rules[%d] %s", i, err)})
+			return
+		}
+
+		if o, ok := existing[rules[i].ID]; ok && !seen[o.ID] {
+			rules[i].Hits = o.Hits
+			rules[i].CreatedAt = o.CreatedAt
+		} else {
+			rules[i].ID = bson.NewObjectId()
+			rules[i].Hits = 0
+			rules[i].CreatedAt = now
+		}
+		seen[rules[i].ID] = true
+		rules[i].Position = i
+		rules[i].UpdatedAt = now
+	}
+
+	err = Store.SetRules(rules)
+	resetRules()
+	if err != nil {
+		log.Printf("Error saving rules: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error saving rules"})
+		return
+	}
+	if rules == nil {
+		rules = []RuleDoc{}
+	}
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// ruleTest is the result of testing a path against the rules
+type ruleTest struct {
+	Path        string   `json:"path"`
+	Link        string   `json:"link,omitempty"`
+	Rule        *RuleDoc `json:"rule"`
+	Destination string   `json:"destination,omitempty"`
+}
+
+// TestRulesHandler shows which rule, if any, matches the path in ?path=, and where it would go. As rules are
+// only tried when there is no link, any link that would be used instead is given too.
+func TestRulesHandler(w http.ResponseWriter, r *http.Request) {
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, APIResponse{"path is required"})
+		return
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	rt := ruleTest{Path: path}
+
+	ld, err := findLinkForPath(strings.TrimPrefix(path, "/"))
+	if err == nil {
+		rt.Link = ld.ShortUrl
+	} else if err != ErrNotFound {
+		log.Printf("Error finding link: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error finding link"})
+		return
+	}
+
+	// Test against what is in the store, not what an instance may have cached
+	resetRules()
+	rd, dest, ok, err := matchRule(path)
+	if err != nil {
+		log.Printf("Error loading rules: %s", err)
+		writeJSON(w, http.StatusInternalServerError, APIResponse{"Error loading rules"})
+		return
+	}
+	if ok {
+		rt.Rule, rt.Destination = &rd, dest
+	}
+
+	writeJSON(w, http.StatusOK, rt)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// putRules replaces the rules through the API, returning them as saved
+func putRules(t *testing.T, body string) []RuleDoc {
+
+	w := serve("PUT", "/api/rules", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT rules: status %v, %s", w.Code, w.Body)
+	}
+	var rules []RuleDoc
+	json.NewDecoder(w.Body).Decode(&rules)
+
+	return rules
+}
+
+// waitForRuleHits waits for the hits on each rule and its stats, which are both recorded in the background, to
+// reach want
+func waitForRuleHits(t *testing.T, want ...int) {
+
+	from := time.Now().Add(-time.Hour)
+	to := time.Now().Add(time.Hour)
+	var hits, stats []int
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		rules, _ := Store.Rules()
+		hits, stats = hits[:0], stats[:0]
+		same := len(rules) == len(want)
+		for i, rd := range rules {
+			s, _ := Store.LinkStats(rd.ID, from, to)
+			hits, stats = append(hits, rd.Hits), append(stats, len(s))
+			same = same && rd.Hits == want[i] && len(s) == want[i]
+		}
+		if same {
+			return
+		}
+	}
+	t.Fatalf("rule hits %v with %v stats, want %v", hits, stats, want)
+}
+
+func TestRules(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		resetRules()
+		defer resetRules()
+
+		// The first rule that matches and gives a valid url wins
+		rules := putRules(t, `[
+			{"pattern": "^/pmid/(\\d+)$", "template": "https://pubmed.example.org/$1"},
+			{"pattern": "^/bad/(.*)$", "template": "https://$1"},
+			{"pattern": "^/(pmid|bad)/(?P<rest>.*)$", "template": "https://other.example.org/${rest}"}
+		]`)
+		if len(rules) != 3 || rules[0].Position != 0 || rules[2].Position != 2 {
+			t.Fatalf("rules %+v", rules)
+		}
+		serve("POST", "/api/links", `{"shortUrl": "pmid/1", "longUrl": "https://example.org/link"}`)
+		serve("HEAD", "/pmid/123", "")
+		serve("HEAD", "/pmid/abc", "")
+
+		for _, c := range []struct {
+			path, want string
+		}{
+			{"/pmid/123", "https://pubmed.example.org/123"},
+			{"/pmid/abc", "https://other.example.org/abc"},
+			{"/bad/", "https://other.example.org/"},
+			{"/pmid/1", "https://example.org/link"},
+		} {
+			w := serve("GET", c.path, "")
+			if w.Header().Get("Location") != c.want {
+				t.Errorf("%s: %v to %q, want %q", c.path, w.Code, w.Header().Get("Location"), c.want)
+			}
+		}
+		if w := serve("GET", "/nothing", ""); w.Header().Get("Location") != "" {
+			t.Errorf("/nothing redirected to %q", w.Header().Get("Location"))
+		}
+
+		// Each redirect is a hit on its rule, but a HEAD, sent before them, isn't
+		waitForRuleHits(t, 1, 0, 2)
+		stats, _ := Store.LinkStats(rules[0].ID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		if len(stats) != 1 || stats[0].Path != "/pmid/123" {
+			t.Errorf("stats for the first rule %+v", stats)
+		}
+
+		// Sent back with its _id a rule keeps its hits in its new place, a new one starts at none
+		js, _ := json.Marshal([]RuleDoc{rules[2], {Pattern: "^/x$", Template: "https://example.org/x"}, rules[0]})
+		rules = putRules(t, string(js))
+		if rules[0].Hits != 2 || rules[1].Hits != 0 || rules[2].Hits != 1 {
+			t.Errorf("hits after reordering %v, %v, %v", rules[0].Hits, rules[1].Hits, rules[2].Hits)
+		}
+		if w := serve("GET", "/pmid/123", ""); w.Header().Get("Location") != "https://other.example.org/123" {
+			t.Errorf("after reordering /pmid/123 went to %q", w.Header().Get("Location"))
+		}
+		waitForRuleHits(t, 3, 0, 1)
+
+		w := serve("PUT", "/api/rules", `[{"pattern": "(", "template": "https://example.org/"}]`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("bad pattern: status %v, want %v", w.Code, http.StatusBadRequest)
+		}
+	})
+}
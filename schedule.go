@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scheduleTimeLayouts are the forms a schedule start or end may take. Without an offset the time is in the
+// entry's time zone.
+var scheduleTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// ScheduleEntry sends visitors to Url between Start and End, either of which may be left open. Times are
+// yyyy-mm-ddThh:mm in TimeZone, an IANA zone such as Australia/Sydney (default UTC), or RFC 3339.
+type ScheduleEntry struct {
+	ID       string `json:"id,omitempty" bson:"id,omitempty"`
+	Start    string `json:"start,omitempty" bson:"start,omitempty"`
+	End      string `json:"end,omitempty" bson:"end,omitempty"`
+	TimeZone string `json:"timeZone,omitempty" bson:"timeZone,omitempty"`
+	Url      string `json:"url" bson:"url"`
+}
+
+// Window returns the start and end of the entry, zero if open ended
+func (s ScheduleEntry) Window() (time.Time, time.Time, error) {
+
+	var start, end time.Time
+
+	loc, err := loadLocation(s.TimeZone)
+	if err != nil {
+		return start, end, err
+	}
+	if s.Start != "" {
+		start, err = parseScheduleTime(s.Start, loc)
+		if err != nil {
+			return start, end, err
+		}
+	}
+	if s.End != "" {
+		end, err = parseScheduleTime(s.End, loc)
+	}
+
+	return start, end, err
+}
+
+// Active reports whether t is within the entry's window
+func (s ScheduleEntry) Active(t time.Time) bool {
+
+	start, end, err := s.Window()
+	if err != nil {
+		return false
+	}
+
+	return (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end))
+}
+
+// variant names the entry in click stats, its ID if it has one, otherwise its position
+func (s ScheduleEntry) variant(i int) string {
+
+	if s.ID != "" {
+		return s.ID
+	}
+
+	return "schedule-" + strconv.Itoa(i+1)
+}
+
+// activeSchedule returns the index of the first schedule entry that is active at t, or -1 if there isn't one
+func activeSchedule(ld LinkDoc, t time.Time) int {
+
+	for i, s := range ld.Schedule {
+		if s.Active(t) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func parseScheduleTime(v string, loc *time.Location) (time.Time, error) {
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range scheduleTimeLayouts {
+		t, err = time.ParseInLocation(layout, v, loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return t, fmt.Errorf("could not understand the time '%s', use yyyy-mm-ddThh:mm or RFC 3339", v)
+}
+
+// locations caches time zones, as time.LoadLocation reads the zone file every time
+var locations = struct {
+	sync.Mutex
+	m map[string]*time.Location
+}{m: make(map[string]*time.Location)}
+
+func loadLocation(name string) (*time.Location, error) {
+
+	locations.Lock()
+	defer locations.Unlock()
+
+	if loc, ok := locations.m[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone '%s'", name)
+	}
+	locations.m[name] = loc
+
+	return loc, nil
+}
+
+// validateSchedule checks each entry has a usable url and a window that makes sense
+func validateSchedule(ss []ScheduleEntry) error {
+
+	for i, s := range ss {
+		if s.Start == "" && s.End == "" {
+			return fmt.Errorf("schedule[%d] needs a start or an end", i)
+		}
+		start, end, err := s.Window()
+		if err != nil {
+			return fmt.Errorf("schedule[%d]: %s", i, err)
+		}
+		if !start.IsZero() && !end.IsZero() && !start.Before(end) {
+			return fmt.Errorf("schedule[%d] start must be before end", i)
+		}
+		err = validateLongUrl(s.Url)
+		if err != nil {
+			return fmt.Errorf("schedule[%d] url: %s", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindow(t *testing.T) {
+
+	for _, c := range []struct {
+		entry      ScheduleEntry
+		start, end string
+	}{
+		{ScheduleEntry{Start: "2024-01-10T09:00", End: "2024-01-11"}, "2024-01-10T09:00:00Z", "2024-01-11T00:00:00Z"},
+		{ScheduleEntry{Start: "2024-01-10T09:00:30"}, "2024-01-10T09:00:30Z", ""},
+		{ScheduleEntry{End: "2024-01-10T09:00", TimeZone: "Australia/Sydney"}, "", "2024-01-09T22:00:00Z"},
+		{ScheduleEntry{Start: "2024-07-10", TimeZone: "Australia/Sydney"}, "2024-07-09T14:00:00Z", ""},
+
+		// An offset wins over the time zone
+		{ScheduleEntry{Start: "2024-01-10T09:00:00+02:00", TimeZone: "Australia/Sydney"}, "2024-01-10T07:00:00Z", ""},
+	} {
+		start, end, err := c.entry.Window()
+		if err != nil {
+			t.Errorf("%+v: %s", c.entry, err)
+			continue
+		}
+		if got := formatWindowTime(start); got != c.start {
+			t.Errorf("%+v: start %s, want %s", c.entry, got, c.start)
+		}
+		if got := formatWindowTime(end); got != c.end {
+			t.Errorf("%+v: end %s, want %s", c.entry, got, c.end)
+		}
+	}
+
+	for _, s := range []ScheduleEntry{{Start: "10/01/2024"}, {Start: "2024-01-10", TimeZone: "Sydney"}} {
+		if _, _, err := s.Window(); err == nil {
+			t.Errorf("%+v: no error", s)
+		}
+	}
+}
+
+// formatWindowTime is t in UTC as RFC 3339, or "" for an open end
+func formatWindowTime(t time.Time) string {
+
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func TestActiveSchedule(t *testing.T) {
+
+	ld := LinkDoc{Schedule: []ScheduleEntry{
+		{Start: "2024-01-10T09:00", End: "2024-01-10T17:00", TimeZone: "Australia/Sydney", Url: "https://example.org/day"},
+		{ID: "launch", Start: "2024-01-10", End: "2024-01-12", Url: "https://example.org/launch"},
+		{Start: "2024-02-01", Url: "https://example.org/after"},
+		{End: "2024-01-01", Url: "https://example.org/before"},
+	}}
+	for _, c := range []struct {
+		at      string
+		want    int
+		variant string
+	}{
+		{"2023-12-31T23:59:59Z", 3, "schedule-4"},
+		{"2024-01-01T00:00:00Z", -1, ""},
+		{"2024-01-09T22:00:00Z", 0, "schedule-1"},
+		{"2024-01-10T05:59:59Z", 0, "schedule-1"},
+		{"2024-01-10T06:00:00Z", 1, "launch"},
+		{"2024-01-11T23:59:59Z", 1, "launch"},
+		{"2024-01-12T00:00:00Z", -1, ""},
+		{"2024-02-01T00:00:00Z", 2, "schedule-3"},
+		{"2030-01-01T00:00:00Z", 2, "schedule-3"},
+	} {
+		at, _ := time.Parse(time.RFC3339, c.at)
+		got := activeSchedule(ld, at)
+		if got != c.want {
+			t.Errorf("%s: entry %v, want %v", c.at, got, c.want)
+			continue
+		}
+		if got >= 0 && ld.Schedule[got].variant(got) != c.variant {
+			t.Errorf("%s: variant %s, want %s", c.at, ld.Schedule[got].variant(got), c.variant)
+		}
+	}
+
+	// An entry that can't be understood is never active
+	ld = LinkDoc{Schedule: []ScheduleEntry{{Start: "soon", Url: "https://example.org/"}}}
+	if i := activeSchedule(ld, time.Now()); i != -1 {
+		t.Errorf("bad entry active: %v", i)
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+
+	for _, c := range []struct {
+		name string
+		s    ScheduleEntry
+		ok   bool
+	}{
+		{"start only", ScheduleEntry{Start: "2024-01-10", Url: "https://example.org/"}, true},
+		{"end only", ScheduleEntry{End: "2024-01-10", Url: "https://example.org/"}, true},
+		{"window", ScheduleEntry{Start: "2024-01-10", End: "2024-01-11", Url: "https://example.org/"}, true},
+		{"open both ends", ScheduleEntry{Url: "https://example.org/"}, false},
+		{"backwards", ScheduleEntry{Start: "2024-01-11", End: "2024-01-10", Url: "https://example.org/"}, false},
+		{"empty window", ScheduleEntry{Start: "2024-01-10", End: "2024-01-10", Url: "https://example.org/"}, false},
+		{"bad time", ScheduleEntry{Start: "tomorrow", Url: "https://example.org/"}, false},
+		{"bad zone", ScheduleEntry{Start: "2024-01-10", TimeZone: "Nowhere/Land", Url: "https://example.org/"}, false},
+		{"bad url", ScheduleEntry{Start: "2024-01-10", Url: "example"}, false},
+	} {
+		if err := validateSchedule([]ScheduleEntry{c.s}); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+const defaultShortCodeLength = 6
+
+// maxShortCodeAttempts is how many times we generate a new code when one collides with an existing link
+const maxShortCodeAttempts = 10
+
+// shortCodeSequence is the name of the counter used by the sequential and hashids generators
+const shortCodeSequence = "shortUrl"
+
+// ErrShortCodeExhausted is returned when every attempt to generate a unique code collided
+var ErrShortCodeExhausted = errors.New("Could not generate a unique shortUrl")
+
+// ShortCodeGenerator creates candidate shortUrls for links created without a vanity slug.
+// Codes are not guaranteed unique - the caller retries on a duplicate.
+type ShortCodeGenerator interface {
+	Generate() (string, error)
+}
+
+// Sequencer hands out increasing numbers for a named counter
+type Sequencer interface {
+	NextSequence(name string) (int64, error)
+}
+
+// NewShortCodeGenerator returns the generator named by strategy:
+// "random" (default), "sequential", "hashids" or "words".
+func NewShortCodeGenerator(strategy string, length int, salt string, seq Sequencer) (ShortCodeGenerator, error) {
+
+	if length <= 0 {
+		length = defaultShortCodeLength
+	}
+
+	switch strings.ToLower(strategy) {
+	case "", "random":
+		return &RandomGenerator{Length: length}, nil
+	case "sequential":
+		return &SequentialGenerator{Seq: seq}, nil
+	case "hashids":
+		return NewHashidsGenerator(salt, length, seq), nil
+	case "words":
+		return &WordsGenerator{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown short code strategy '%s'", strategy)
+}
+
+// ShortCodeGeneratorFromEnv sets up the generator from LINKR_SHORTCODE_STRATEGY, LINKR_SHORTCODE_LENGTH
+// and LINKR_SHORTCODE_SALT
+func ShortCodeGeneratorFromEnv(seq Sequencer) (ShortCodeGenerator, error) {
+
+	length, _ := strconv.Atoi(os.Getenv("LINKR_SHORTCODE_LENGTH"))
+
+	return NewShortCodeGenerator(os.Getenv("LINKR_SHORTCODE_STRATEGY"), length, os.Getenv("LINKR_SHORTCODE_SALT"), seq)
+}
+
+// RandomGenerator creates random base62 codes
+type RandomGenerator struct {
+	Length int
+}
+
+func (g *RandomGenerator) Generate() (string, error) {
+
+	b := make([]byte, g.Length)
+	max := big.NewInt(int64(len(base62Alphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = base62Alphabet[n.Int64()]
+	}
+
+	return string(b), nil
+}
+
+// SequentialGenerator creates base62 codes from a stored counter, so 1, 2, ... z, 10, 11 ...
+type SequentialGenerator struct {
+	Seq Sequencer
+}
+
+func (g *SequentialGenerator) Generate() (string, error) {
+
+	n, err := g.Seq.NextSequence(shortCodeSequence)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeBase(n, base62Alphabet), nil
+}
+
+// HashidsGenerator obfuscates a stored counter in the style of hashids (http://hashids.org), so
+// consecutive links don't get guessable, consecutive codes.
+type HashidsGenerator struct {
+	Seq       Sequencer
+	Salt      string
+	MinLength int
+	alphabet  string
+	guards    string
+}
+
+// NewHashidsGenerator sets up the salted alphabet. Codes are padded out to minLength.
+func NewHashidsGenerator(salt string, minLength int, seq Sequencer) *HashidsGenerator {
+
+	g := &HashidsGenerator{Seq: seq, Salt: salt, MinLength: minLength}
+
+	// A few characters are set aside to pad short codes, the rest encode the number
+	a := consistentShuffle(base62Alphabet, salt)
+	g.guards = a[:4]
+	g.alphabet = a[4:]
+
+	return g
+}
+
+func (g *HashidsGenerator) Generate() (string, error) {
+
+	n, err := g.Seq.NextSequence(shortCodeSequence)
+	if err != nil {
+		return "", err
+	}
+
+	return g.Encode(n), nil
+}
+
+// Encode turns n into an obfuscated code
+func (g *HashidsGenerator) Encode(n int64) string {
+
+	// The lottery character re-shuffles the alphabet per number, which scatters consecutive values
+	lottery := g.alphabet[n%int64(len(g.alphabet))]
+	a := consistentShuffle(g.alphabet, string(lottery)+g.Salt)
+	code := string(lottery) + encodeBase(n, a)
+
+	// Pad with guards, which never appear in the encoded part so can be stripped to decode
+	for i := 0; len(code) < g.MinLength; i++ {
+		guard := g.guards[(int(n)+i)%len(g.guards)]
+		if i%2 == 0 {
+			code = string(guard) + code
+		} else {
+			code = code + string(guard)
+		}
+	}
+
+	return code
+}
+
+// WordsGenerator creates pronounceable adjective-noun pairs, eg "brave-otter"
+type WordsGenerator struct{}
+
+func (g *WordsGenerator) Generate() (string, error) {
+
+	a, err := rand.Int(rand.Reader, big.NewInt(int64(len(adjectives))))
+	if err != nil {
+		return "", err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(nouns))))
+	if err != nil {
+		return "", err
+	}
+
+	return adjectives[a.Int64()] + "-" + nouns[n.Int64()], nil
+}
+
+// encodeBase writes n using the characters in alphabet as digits
+func encodeBase(n int64, alphabet string) string {
+
+	base := int64(len(alphabet))
+	if n == 0 {
+		return alphabet[:1]
+	}
+
+	var b []byte
+	for n > 0 {
+		b = append([]byte{alphabet[n%base]}, b...)
+		n = n / base
+	}
+
+	return string(b)
+}
+
+// consistentShuffle reorders alphabet deterministically for a given salt
+func consistentShuffle(alphabet, salt string) string {
+
+	if salt == "" {
+		return alphabet
+	}
+
+	a := []byte(alphabet)
+	h := sha256.Sum256([]byte(salt))
+	for i := len(a) - 1; i > 0; i-- {
+		j := int(h[i%len(h)]) % (i + 1)
+		a[i], a[j] = a[j], a[i]
+	}
+
+	return string(a)
+}
+
+var adjectives = []string{
+	"able", "amber", "bold", "brave", "brisk", "calm", "clever", "cosy", "crisp", "daring",
+	"eager", "early", "fancy", "fast", "fresh", "gentle", "glad", "golden", "grand", "happy",
+	"hardy", "jolly", "keen", "kind", "lively", "lucky", "merry", "mighty", "modest", "noble",
+	"polite", "proud", "quick", "quiet", "rapid", "ready", "rosy", "royal", "sandy", "sharp",
+	"shiny", "silent", "silver", "simple", "sleek", "smart", "snowy", "solid", "sunny", "super",
+	"swift", "tidy", "tiny", "tough", "vivid", "warm", "wild", "wise", "witty", "young",
+}
+
+var nouns = []string{
+	"badger", "banjo", "beacon", "cactus", "canyon", "comet", "cobra", "dingo", "dolphin", "eagle",
+	"ember", "falcon", "fern", "galah", "garden", "gecko", "harbor", "heron", "island", "jaguar",
+	"kestrel", "koala", "lagoon", "lemon", "lotus", "magpie", "maple", "meadow", "mango", "numbat",
+	"ocean", "orbit", "otter", "panda", "parrot", "pebble", "pepper", "pigeon", "quokka", "raven",
+	"river", "rocket", "saddle", "salmon", "summit", "tiger", "timber", "tulip", "turtle", "valley",
+	"velvet", "walrus", "wattle", "willow", "wombat", "yabby", "zebra", "zephyr", "acorn", "breeze",
+}
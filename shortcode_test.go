@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// listGenerator hands out codes in order, then the last one forever
+type listGenerator struct {
+	codes []string
+	calls int
+}
+
+func (g *listGenerator) Generate() (string, error) {
+
+	code := g.codes[minInt(g.calls, len(g.codes)-1)]
+	g.calls++
+
+	return code, nil
+}
+
+func TestEncodeBase(t *testing.T) {
+
+	for _, c := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{9, "9"},
+		{10, "a"},
+		{61, "Z"},
+		{62, "10"},
+		{3843, "ZZ"},
+		{3844, "100"},
+	} {
+		if got := encodeBase(c.n, base62Alphabet); got != c.want {
+			t.Errorf("%d: %s, want %s", c.n, got, c.want)
+		}
+	}
+}
+
+func TestShortCodeGenerators(t *testing.T) {
+
+	code := regexp.MustCompile(`^[0-9a-zA-Z]+$`)
+	for _, c := range []struct {
+		strategy string
+		length   int
+		valid    *regexp.Regexp
+	}{
+		{"", 0, regexp.MustCompile(`^[0-9a-zA-Z]{6}$`)},
+		{"random", 9, regexp.MustCompile(`^[0-9a-zA-Z]{9}$`)},
+		{"Sequential", 0, code},
+		{"hashids", 6, regexp.MustCompile(`^[0-9a-zA-Z]{6,}$`)},
+		{"words", 0, regexp.MustCompile(`^[a-z]+-[a-z]+$`)},
+	} {
+		g, err := NewShortCodeGenerator(c.strategy, c.length, "salt", NewMemoryStore())
+		if err != nil {
+			t.Fatalf("%s: %s", c.strategy, err)
+		}
+		for i := 0; i < 50; i++ {
+			s, err := g.Generate()
+			if err != nil || !c.valid.MatchString(s) || validateShortUrl(s) != nil {
+				t.Errorf("%s: %q, %v", c.strategy, s, err)
+				break
+			}
+		}
+	}
+
+	if _, err := NewShortCodeGenerator("uuid", 0, "", nil); err == nil {
+		t.Error("unknown strategy: no error")
+	}
+}
+
+func TestSequentialGenerator(t *testing.T) {
+
+	g := &SequentialGenerator{Seq: NewMemoryStore()}
+	var got []string
+	for i := 0; i < 3; i++ {
+		s, _ := g.Generate()
+		got = append(got, s)
+	}
+	if strings.Join(got, ",") != "1,2,3" {
+		t.Errorf("codes %v, want 1, 2, 3", got)
+	}
+}
+
+func TestHashidsGenerator(t *testing.T) {
+
+	a := NewHashidsGenerator("one", 6, nil)
+	b := NewHashidsGenerator("two", 6, nil)
+
+	seen := make(map[string]bool)
+	for n := int64(1); n <= 5000; n++ {
+		s := a.Encode(n)
+		if seen[s] {
+			t.Fatalf("%d: %s is repeated", n, s)
+		}
+		seen[s] = true
+		if len(s) < 6 {
+			t.Errorf("%d: %s is shorter than 6", n, s)
+		}
+	}
+
+	// The same salt always gives the same code, another salt a different one
+	if a.Encode(42) != NewHashidsGenerator("one", 6, nil).Encode(42) {
+		t.Error("same salt, different code")
+	}
+	if a.Encode(42) == b.Encode(42) {
+		t.Error("different salts, same code")
+	}
+
+	// Consecutive numbers don't give codes that differ in one place
+	if x, y := a.Encode(100), a.Encode(101); x[:len(x)-1] == y[:len(y)-1] {
+		t.Errorf("100 and 101 are %s and %s", x, y)
+	}
+}
+
+func TestGeneratedLinkCollisions(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		defer func(g ShortCodeGenerator) { ShortCodes = g }(ShortCodes)
+		serve("POST", "/api/links", `{"shortUrl": "taken", "longUrl": "https://example.org/taken"}`)
+
+		// A code that is taken or reserved is passed over for the next one
+		g := &listGenerator{codes: []string{"taken", "api", "fresh"}}
+		ShortCodes = g
+		w := serve("POST", "/api/links", `{"longUrl": "https://example.org/new"}`)
+		if w.Code != http.StatusCreated || w.Header().Get("Location") != "/api/links/fresh" || g.calls != 3 {
+			t.Errorf("status %v at %q after %v codes, %s", w.Code, w.Header().Get("Location"), g.calls, w.Body)
+		}
+		if ld, _ := Store.FindLink("fresh"); ld.LongUrl != "https://example.org/new" {
+			t.Errorf("fresh = %+v", ld)
+		}
+		if ld, _ := Store.FindLink("taken"); ld.LongUrl != "https://example.org/taken" {
+			t.Errorf("taken was overwritten: %+v", ld)
+		}
+
+		// Giving up after maxShortCodeAttempts
+		g = &listGenerator{codes: []string{"taken"}}
+		ShortCodes = g
+		w = serve("POST", "/api/links", `{"longUrl": "https://example.org/new"}`)
+		if w.Code != http.StatusInternalServerError || g.calls != maxShortCodeAttempts {
+			t.Errorf("status %v after %v codes, want %v after %v", w.Code, g.calls, http.StatusInternalServerError,
+				maxShortCodeAttempts)
+		}
+
+		// Nothing is generated for a link that isn't valid anyway
+		g = &listGenerator{codes: []string{"unused"}}
+		ShortCodes = g
+		if w = serve("POST", "/api/links", `{"longUrl": "not a url"}`); w.Code != http.StatusBadRequest || g.calls != 0 {
+			t.Errorf("bad link: status %v after %v codes", w.Code, g.calls)
+		}
+	})
+}
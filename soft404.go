@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// soft404MaxBody is the most of a page read to look for "not found" phrases
+const soft404MaxBody = 64 * 1024
+
+// defaultSoft404Title are titles that mean a page is really a "not found" page, for all domains. Each must be the
+// whole title, or a whole part of it between separators such as " | ", as a title that only mentions 404 or not
+// found is often a real page, eg "404 patients treated" or "Cause not found in study". defaultSoft404Body are
+// phrases that mean the same anywhere in the page.
+var (
+	defaultSoft404Title = []string{
+		`(error )?404( error)?`,
+		`((error )?404 )?((page|file|document|article) )?not found[.!]?`,
+		`((the|this) )?(page|file|document|article) (does not|doesn't|no longer) exists?[.!]?`,
+		`((the|this) )?(page|file|document|article) is no longer available[.!]?`,
+	}
+	defaultSoft404Body = []string{
+		`page not found`,
+		`(page|article|document) (could not|cannot|can't) be found`,
+		`(page|article|document) (does not|doesn't|no longer) exists?`,
+	}
+)
+
+var htmlTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// titleSeparator splits a title such as "Page not found | Example" into its parts
+var titleSeparator = regexp.MustCompile(`\s*[|–—·»]\s*|\s+-\s+|:\s+`)
+
+// Soft404Patterns are the patterns for one domain in the LINKR_CHECK_SOFT404_RULES file. Title and body are regular
+// expressions, matched without regard to case, and minBytes is the smallest HTML page that isn't suspiciously small,
+// or 0 to not mind the size.
+type Soft404Patterns struct {
+	Title    []string `json:"title"`
+	Body     []string `json:"body"`
+	MinBytes int      `json:"minBytes"`
+}
+
+type soft404Matcher struct {
+	title    []*regexp.Regexp
+	body     []*regexp.Regexp
+	minBytes int
+}
+
+// Soft404Detector spots pages that respond 200 OK but are really "not found" pages: ones with a title or body
+// that matches a pattern, HTML pages that are suspiciously small, if a minimum size is set, or that a deeper link
+// has been redirected to the home page of. The built in patterns apply to every domain, and the rules file can
+// add more for all domains, as "*", or for a domain and its subdomains.
+type Soft404Detector struct {
+	titles  []*regexp.Regexp // the built in title patterns, anchored to match a whole title or part of one
+	all     soft404Matcher
+	domains map[string]soft404Matcher
+}
+
+// NewSoft404DetectorFromEnv sets up a detector with the rules in the file LINKR_CHECK_SOFT404_RULES, if set, and
+// LINKR_CHECK_SOFT404_MIN_BYTES. It returns nil unless LINKR_CHECK_SOFT404 is "on", as looking at the page costs
+// another request for every link that is up.
+func NewSoft404DetectorFromEnv() (*Soft404Detector, error) {
+
+	if os.Getenv("LINKR_CHECK_SOFT404") != "on" {
+		return nil, nil
+	}
+
+	rules := make(map[string]Soft404Patterns)
+	if path := os.Getenv("LINKR_CHECK_SOFT404_RULES"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &rules)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	minBytes := 0
+	if n, err := strconv.Atoi(os.Getenv("LINKR_CHECK_SOFT404_MIN_BYTES")); err == nil && n > 0 {
+		minBytes = n
+	}
+
+	return NewSoft404Detector(rules, minBytes)
+}
+
+// NewSoft404Detector sets up a detector from rules by domain, with "*" for every domain
+func NewSoft404Detector(rules map[string]Soft404Patterns, minBytes int) (*Soft404Detector, error) {
+
+	d := &Soft404Detector{domains: make(map[string]soft404Matcher)}
+
+	for _, s := range defaultSoft404Title {
+		d.titles = append(d.titles, regexp.MustCompile("(?i)^(?:"+s+")$"))
+	}
+
+	all := rules["*"]
+	all.Body = append(append([]string{}, defaultSoft404Body...), all.Body...)
+	if all.MinBytes == 0 {
+		all.MinBytes = minBytes
+	}
+
+	var err error
+	d.all, err = compileSoft404(all, 0)
+	if err != nil {
+		return nil, fmt.Errorf("soft 404 rules for *: %s", err)
+	}
+
+	for domain, p := range rules {
+		if domain == "*" {
+			continue
+		}
+		m, err := compileSoft404(p, d.all.minBytes)
+		if err != nil {
+			return nil, fmt.Errorf("soft 404 rules for %s: %s", domain, err)
+		}
+		d.domains[strings.ToLower(domain)] = m
+	}
+
+	return d, nil
+}
+
+// compileSoft404 compiles the patterns in p, which has minBytes unless it sets its own
+func compileSoft404(p Soft404Patterns, minBytes int) (soft404Matcher, error) {
+
+	m := soft404Matcher{minBytes: minBytes}
+	if p.MinBytes != 0 {
+		m.minBytes = p.MinBytes
+	}
+
+	for _, s := range p.Title {
+		re, err := regexp.Compile("(?i)" + s)
+		if err != nil {
+			return m, err
+		}
+		m.title = append(m.title, re)
+	}
+	for _, s := range p.Body {
+		re, err := regexp.Compile("(?i)" + s)
+		if err != nil {
+			return m, err
+		}
+		m.body = append(m.body, re)
+	}
+
+	return m, nil
+}
+
+// matchers are the matchers for host, most specific first: the host, the domains above it, then every domain
+func (d *Soft404Detector) matchers(host string) []soft404Matcher {
+
+	var r []soft404Matcher
+
+	host = strings.ToLower(host)
+	for {
+		if m, ok := d.domains[host]; ok {
+			r = append(r, m)
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+
+	return append(r, d.all)
+}
+
+// Redirected says why longUrl is soft broken if it was redirected to the home page of finalUrl, or "" if it wasn't
+func (d *Soft404Detector) Redirected(longUrl, finalUrl string) string {
+
+	lu, err := url.Parse(longUrl)
+	if err != nil {
+		return ""
+	}
+	fu, err := url.Parse(finalUrl)
+	if err != nil {
+		return ""
+	}
+
+	if strings.Trim(lu.Path, "/") != "" && strings.Trim(fu.Path, "/") == "" && fu.RawQuery == "" {
+		return "Redirected to the home page " + finalUrl
+	}
+
+	return ""
+}
+
+// Page says why the page at finalUrl is soft broken, or "" if it looks fine. body is as much of the page as was
+// read, and complete is false if there was more.
+func (d *Soft404Detector) Page(finalUrl, contentType string, body []byte, complete bool) string {
+
+	host := ""
+	if u, err := url.Parse(finalUrl); err == nil {
+		host = u.Hostname()
+	}
+	ms := d.matchers(host)
+
+	// The most specific minimum size wins. Small is only suspicious for a web page, not eg a JSON endpoint.
+	isHTML := strings.HasPrefix(strings.ToLower(contentType), "text/html")
+	if isHTML && complete && len(body) < ms[0].minBytes {
+		return fmt.Sprintf("Page is only %v bytes", len(body))
+	}
+
+	title := ""
+	if t := htmlTitle.FindSubmatch(body); t != nil {
+		title = strings.TrimSpace(html.UnescapeString(string(t[1])))
+	}
+	// The built in titles must be all of the title, or all of a part of it
+	if title != "" {
+		parts := append([]string{title}, titleSeparator.Split(title, -1)...)
+		for _, re := range d.titles {
+			for _, p := range parts {
+				if re.MatchString(p) {
+					return fmt.Sprintf("Title \"%s\" says the page wasn't found", title)
+				}
+			}
+		}
+	}
+
+	for _, m := range ms {
+		for _, re := range m.title {
+			if title != "" && re.MatchString(title) {
+				return fmt.Sprintf("Title \"%s\" matches %s", title, strings.TrimPrefix(re.String(), "(?i)"))
+			}
+		}
+		for _, re := range m.body {
+			if re.Match(body) {
+				return fmt.Sprintf("Page matches %s", strings.TrimPrefix(re.String(), "(?i)"))
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// page is an HTML page with the title and body text
+func page(title, text string) []byte {
+	return []byte("<html><head><title>" + title + "</title></head><body><p>" + text + "</p></body></html>")
+}
+
+func TestSoft404Titles(t *testing.T) {
+
+	d, err := NewSoft404Detector(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for title, want := range map[string]bool{
+		"404":                              true,
+		"Error 404":                        true,
+		"404 Not Found":                    true,
+		"Not Found":                        true,
+		"Page not found":                   true,
+		"Page Not Found | Example":         true,
+		"Example - Page not found":         true,
+		"Error 404: Page not found":        true,
+		"Not found &mdash; Example Blog":   true,
+		"This page no longer exists.":      true,
+		"Article is no longer available":   true,
+		"  page not found\n":               true,
+		"404 patients treated in trial":    false,
+		"Cause not found in study":         false,
+		"Route 404 - Scenic Drives":        false,
+		"Why the gene was not found":       false,
+		"Files that no longer exist | Ops": false,
+		"HTTP 404 explained":               false,
+		"":                                 false,
+	} {
+		reason := d.Page("https://example.org/a", "text/html", page(title, "Hello"), true)
+		if (reason != "") != want {
+			t.Errorf("%q: %q, want soft 404 %v", title, reason, want)
+		}
+	}
+}
+
+func TestSoft404Page(t *testing.T) {
+
+	d, err := NewSoft404Detector(map[string]Soft404Patterns{
+		"*":                    {Title: []string{"oops"}},
+		"journals.example.com": {Title: []string{"article unavailable"}, Body: []string{`class="error-404"`}, MinBytes: 200},
+	}, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("x", 300)
+	for _, c := range []struct {
+		url, contentType string
+		body             []byte
+		complete         bool
+		want             string
+	}{
+		{"https://example.org/a", "text/html", page("Welcome", long), true, ""},
+		{"https://example.org/a", "text/html", page("Hi", long+"Sorry, the page could not be found."), true, "Page matches"},
+		{"https://example.org/a", "text/html", page("Oops, something broke", long), true, `Title "Oops, something broke" matches oops`},
+
+		// Rules for a domain are for its subdomains too, and only there
+		{"https://journals.example.com/1", "text/html", page("Article unavailable", long), true, "Title"},
+		{"https://www.journals.example.com/1", "text/html", page("Paper", `<div class="error-404">`+long), true, "Page matches"},
+		{"https://example.org/1", "text/html", page("Article unavailable", long), true, ""},
+
+		// The smallest page is the most specific one set, and only for complete HTML pages
+		{"https://example.org/a", "text/html; charset=utf-8", []byte("<p>hi</p>"), true, "Page is only 9 bytes"},
+		{"https://example.org/a", "text/html", page("Paper", long[:120]), true, ""},
+		{"https://journals.example.com/1", "text/html", page("Paper", long[:120]), true, "Page is only"},
+		{"https://journals.example.com/1", "text/html", page("Paper", long[:120]), false, ""},
+		{"https://example.org/a.json", "application/json", []byte("{}"), true, ""},
+	} {
+		got := d.Page(c.url, c.contentType, c.body, c.complete)
+		if (c.want == "") != (got == "") || !strings.HasPrefix(got, c.want) {
+			t.Errorf("%s %.40q: %q, want %q", c.url, c.body, got, c.want)
+		}
+	}
+
+	if _, err := NewSoft404Detector(map[string]Soft404Patterns{"example.org": {Body: []string{"("}}}, 0); err == nil {
+		t.Error("bad pattern: no error")
+	}
+}
+
+func TestSoft404Redirected(t *testing.T) {
+
+	d, _ := NewSoft404Detector(nil, 0)
+	for _, c := range []struct {
+		longUrl, finalUrl string
+		want              bool
+	}{
+		{"https://example.org/papers/1", "https://example.org/", true},
+		{"https://example.org/papers/1", "https://www.example.org", true},
+		{"https://example.org/papers/1", "https://example.org/?page=1", false},
+		{"https://example.org/papers/1", "https://example.org/papers/2", false},
+		{"https://example.org/", "https://www.example.org/", false},
+		{"https://example.org", "https://example.org/", false},
+	} {
+		if got := d.Redirected(c.longUrl, c.finalUrl); (got != "") != c.want {
+			t.Errorf("%s to %s: %q, want %v", c.longUrl, c.finalUrl, got, c.want)
+		}
+	}
+}
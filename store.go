@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned by a LinkStore when the requested link does not exist
+var ErrNotFound = errors.New("not found")
+
+// LinkStore is everything the handlers need from the database. MongoConnection is the original
+// implementation, MemoryStore and FileStore let linkr run without a database server.
+type LinkStore interface {
+	FindLink(shortUrl string) (LinkDoc, error)
+	AddLink(ld LinkDoc) error
+	UpdateLink(shortUrl string, ld LinkDoc) (LinkDoc, error)
+	DeleteLink(shortUrl string) error
+	IncrementClicks(shortUrl string) error
+	RecordStats(s LinkStatsDoc) error
+	LinkStats(linkID bson.ObjectId, from, to time.Time) ([]LinkStatsDoc, error)
+	ClickCounts(linkID bson.ObjectId, from, to time.Time, interval string) ([]ClickGroup, error)
+	UpdateCheckState(shortUrl string, lc LinkCheckDoc, failures int, movedTo string, nextCheckAt time.Time) error
+	RecordCheck(lc LinkCheckDoc) error
+	Checks(linkID bson.ObjectId, n int) ([]LinkCheckDoc, error)
+	DueLinks(t time.Time, n int) ([]LinkDoc, error)
+	Popular(namespace string, n int) ([]LinkDoc, error)
+	Trending(since time.Time, n int) ([]TrendingLink, error)
+	Latest(namespace string, n int) ([]ResourcesDoc, error)
+	Broken() ([]LinkDoc, error)
+	Moved() ([]LinkDoc, error)
+	Links() ([]LinkDoc, error)
+	NextSequence(name string) (int64, error)
+	Rules() ([]RuleDoc, error)
+	SetRules(rules []RuleDoc) error
+	IncrementRuleHits(id bson.ObjectId) error
+}
+
+// storeKind is the backend named by LINKR_STORE, defaulting to mongo
+func storeKind() string {
+
+	k := os.Getenv("LINKR_STORE")
+	if k == "" {
+		k = "mongo"
+	}
+
+	return k
+}
+
+// NewLinkStore sets up the backend named by LINKR_STORE: "mongo" (default), "memory" or "file".
+// The file store keeps its data in the directory LINKR_STORE_PATH.
+func NewLinkStore() (LinkStore, error) {
+
+	switch storeKind() {
+	case "mongo":
+		return NewMongoConnection(), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		p := os.Getenv("LINKR_STORE_PATH")
+		if p == "" {
+			p = "./data"
+		}
+		return NewFileStore(p)
+	}
+
+	return nil, fmt.Errorf("Unknown LINKR_STORE '%s'", storeKind())
+}
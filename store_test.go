@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const testAPIKey = "test-key"
+
+// withStores runs fn against each store that doesn't need a database server, as the global Store
+func withStores(t *testing.T, fn func(t *testing.T)) {
+
+	os.Setenv("LINKR_API_KEY", testAPIKey)
+
+	t.Run("memory", func(t *testing.T) {
+		Store = NewMemoryStore()
+		fn(t)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "linkr")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		fs, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Flush()
+		Store = fs
+		fn(t)
+	})
+}
+
+// serve sends a request through the router, with the API key for /api paths
+func serve(method, path, body string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if strings.HasPrefix(path, "/api/") {
+		r.Header.Set("Authorization", "Bearer "+testAPIKey)
+	}
+	w := httptest.NewRecorder()
+	NewRouter().ServeHTTP(w, r)
+
+	return w
+}
+
+// waitForClicks waits for the clicks on a link and its stats, which are both recorded in the background, to reach n
+func waitForClicks(t *testing.T, shortUrl string, n int) {
+
+	from := time.Now().Add(-time.Hour)
+	to := time.Now().Add(time.Hour)
+	clicks, stats := 0, 0
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		ld, err := Store.FindLink(shortUrl)
+		if err != nil {
+			continue
+		}
+		s, _ := Store.LinkStats(ld.ID, from, to)
+		clicks, stats = ld.Clicks, len(s)
+		if clicks == n && stats == n {
+			return
+		}
+	}
+	t.Fatalf("clicks on %s = %v with %v stats, want %v", shortUrl, clicks, stats, n)
+}
+
+func TestLinkLifecycle(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		w := serve("POST", "/api/links", `{"shortUrl": "r2199", "longUrl": "https://example.org/a", "title": "A"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: status %v, %s", w.Code, w.Body)
+		}
+
+		w = serve("POST", "/api/links", `{"shortUrl": "r2199", "longUrl": "https://example.org/b"}`)
+		if w.Code != http.StatusConflict {
+			t.Errorf("create again: status %v, want %v", w.Code, http.StatusConflict)
+		}
+
+		w = serve("GET", "/r2199", "")
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "https://example.org/a" {
+			t.Errorf("redirect: %v to %q", w.Code, w.Header().Get("Location"))
+		}
+		waitForClicks(t, "r2199", 1)
+
+		// A HEAD is redirected but not counted
+		w = serve("HEAD", "/r2199", "")
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("HEAD: status %v, want %v", w.Code, http.StatusSeeOther)
+		}
+		time.Sleep(20 * time.Millisecond)
+		waitForClicks(t, "r2199", 1)
+
+		w = serve("PATCH", "/api/links/r2199", `{"longUrl": "https://example.org/c"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("update: status %v, %s", w.Code, w.Body)
+		}
+		w = serve("GET", "/r2199", "")
+		if w.Header().Get("Location") != "https://example.org/c" {
+			t.Errorf("redirect after update to %q", w.Header().Get("Location"))
+		}
+		waitForClicks(t, "r2199", 2)
+
+		w = serve("GET", "/r2199.json", "")
+		ld := LinkDoc{}
+		err := json.Unmarshal(w.Body.Bytes(), &ld)
+		if err != nil {
+			t.Fatalf("link JSON: %s, %s", err, w.Body)
+		}
+		if ld.LongUrl != "https://example.org/c" || ld.Title != "A" || ld.Clicks != 2 {
+			t.Errorf("link JSON = %+v", ld)
+		}
+
+		w = serve("DELETE", "/api/links/r2199", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete: status %v, %s", w.Code, w.Body)
+		}
+		_, err = Store.FindLink("r2199")
+		if err != ErrNotFound {
+			t.Errorf("FindLink after delete: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestAPIRequiresKey(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		r := httptest.NewRequest("POST", "/api/links", strings.NewReader(`{"shortUrl": "x", "longUrl": "https://example.org"}`))
+		w := httptest.NewRecorder()
+		NewRouter().ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("status %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+		if _, err := Store.FindLink("x"); err != ErrNotFound {
+			t.Errorf("link was added without the key")
+		}
+	})
+}
+
+func TestBrokenLinks(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		for _, ld := range []LinkDoc{
+			{ShortUrl: "ok", LongUrl: "https://example.org/ok"},
+			{ShortUrl: "gone", LongUrl: "https://example.org/gone"},
+			{ShortUrl: "secret", LongUrl: "https://example.org/secret", PasswordHash: "x"},
+		} {
+			ld.ID = bson.NewObjectId()
+			ld.Active = true
+			err := Store.AddLink(ld)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		now := time.Now()
+		Store.UpdateCheckState("ok", LinkCheckDoc{StatusCode: 200, CreatedAt: now}, 0, "", now)
+		Store.UpdateCheckState("gone", LinkCheckDoc{StatusCode: 404, ErrorClass: CheckErrorHTTP, Error: "404 Not Found", CreatedAt: now}, 1, "", now)
+		Store.UpdateCheckState("secret", LinkCheckDoc{StatusCode: 504, ErrorClass: CheckErrorDNS, Error: "lookup example.org: no such host", CreatedAt: now}, 1, "", now)
+
+		w := serve("GET", "/broken.json", "")
+		var broken []LinkDoc
+		err := json.Unmarshal(w.Body.Bytes(), &broken)
+		if err != nil {
+			t.Fatalf("%s, %s", err, w.Body)
+		}
+		got := map[string]LinkDoc{}
+		for _, ld := range broken {
+			got[ld.ShortUrl] = ld
+		}
+		if len(got) != 2 {
+			t.Fatalf("broken = %v, want gone and secret", broken)
+		}
+		if got["gone"].LastErrorClass != CheckErrorHTTP || got["gone"].LastError != "404 Not Found" {
+			t.Errorf("gone = %+v", got["gone"])
+		}
+		if s := got["secret"]; s.LastErrorClass != CheckErrorDNS || s.LastError != "" || s.LongUrl != "" {
+			t.Errorf("secret shows %q, %q", s.LastError, s.LongUrl)
+		}
+
+		// A link that failed its last check shows the direct link page to a GET, but redirects anything else
+		w = serve("GET", "/gone", "")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "https://example.org/gone") {
+			t.Errorf("GET broken link: status %v", w.Code)
+		}
+		w = serve("POST", "/gone", "")
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("POST broken link: status %v, want %v", w.Code, http.StatusSeeOther)
+		}
+		waitForClicks(t, "gone", 2)
+	})
+}
+
+func TestFileStoreReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "linkr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Store = fs
+	os.Setenv("LINKR_API_KEY", testAPIKey)
+
+	w := serve("POST", "/api/links", `{"shortUrl": "keep", "longUrl": "https://example.org/keep"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %v, %s", w.Code, w.Body)
+	}
+	serve("GET", "/keep", "")
+	serve("GET", "/keep", "")
+	waitForClicks(t, "keep", 2)
+
+	err = fs.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs2, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := fs2.FindLink("keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld.LongUrl != "https://example.org/keep" || ld.Clicks != 2 {
+		t.Errorf("reloaded link = %+v", ld)
+	}
+	stats, _ := fs2.LinkStats(ld.ID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if len(stats) != 2 {
+		t.Errorf("reloaded %v clicks in stats, want 2", len(stats))
+	}
+}
+
+func TestUpdateReplacesLists(t *testing.T) {
+
+	withStores(t, func(t *testing.T) {
+
+		w := serve("POST", "/api/links", `{"shortUrl": "l", "longUrl": "https://example.org/",
+			"languages": {"en": "https://example.org/en", "es": "https://example.org/es"},
+			"schedule": [{"start": "2020-01-01T00:00:00Z", "end": "2020-02-01T00:00:00Z", "url": "https://example.org/s1"}]}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: status %v, %s", w.Code, w.Body)
+		}
+
+		w = serve("PATCH", "/api/links/l", `{"languages": {"en": "https://example.org/en2"},
+			"schedule": [{"end": "2019-01-01T00:00:00Z", "url": "https://example.org/s2"}]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("update: status %v, %s", w.Code, w.Body)
+		}
+
+		ld, _ := Store.FindLink("l")
+		if len(ld.Languages) != 1 || ld.Languages["en"] != "https://example.org/en2" {
+			t.Errorf("languages = %v, want only en", ld.Languages)
+		}
+		if len(ld.Schedule) != 1 || ld.Schedule[0].Start != "" || ld.Schedule[0].Url != "https://example.org/s2" {
+			t.Errorf("schedule = %+v, want only the new entry", ld.Schedule)
+		}
+	})
+}
+
+func TestMemoryStoreCopies(t *testing.T) {
+
+	m := NewMemoryStore()
+	ld := LinkDoc{ShortUrl: "c", LongUrl: "https://example.org/", Languages: LanguageURLs{"en": "https://example.org/en"},
+		StripParams: []string{"fbclid"}}
+	err := m.AddLink(ld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld.Languages["en"] = "https://example.org/changed"
+	ld.StripParams[0] = "changed"
+
+	found, _ := m.FindLink("c")
+	if found.Languages["en"] != "https://example.org/en" || found.StripParams[0] != "fbclid" {
+		t.Errorf("changing the added doc changed the stored link: %+v", found)
+	}
+
+	ld, err = m.UpdateLink("c", found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld.Languages["en"] = "https://example.org/changed"
+	if found, _ = m.FindLink("c"); found.Languages["en"] != "https://example.org/en" {
+		t.Errorf("changing the updated doc changed the stored link: %+v", found)
+	}
+}
+
+// statsLine is a line of stats.jsonl for a click on linkID at t
+func statsLine(linkID bson.ObjectId, t time.Time) string {
+
+	js, _ := json.Marshal(LinkStatsDoc{ID: bson.NewObjectId(), LinkID: linkID, CreatedAt: t})
+
+	return string(js) + "\n"
+}
+
+func TestFileStoreBadLines(t *testing.T) {
+
+	id := bson.NewObjectId()
+	good := statsLine(id, time.Now()) + statsLine(id, time.Now())
+	for _, c := range []struct {
+		name, stats string
+		ok          bool
+	}{
+		{"cut off", good + `{"_id": "5a`, true},
+		{"no newline", good + strings.TrimSuffix(statsLine(id, time.Now()), "\n"), true},
+		{"bad last line", good + "{bad}\n", true},
+		{"bad middle line", "{bad}\n" + good, false},
+	} {
+		dir, err := ioutil.TempDir("", "linkr")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		err = ioutil.WriteFile(filepath.Join(dir, fileStoreStats), []byte(c.stats), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs, err := NewFileStore(dir)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: no error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		stats, _ := fs.LinkStats(id, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		b, _ := ioutil.ReadFile(filepath.Join(dir, fileStoreStats))
+		if len(stats) != 2 || string(b) != good {
+			t.Errorf("%s: %v stats, file\n%s", c.name, len(stats), b)
+		}
+
+		// What is appended next is a line of its own
+		fs.RecordStats(LinkStatsDoc{ID: bson.NewObjectId(), LinkID: id, CreatedAt: time.Now()})
+		fs, err = NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("%s: reload: %s", c.name, err)
+		}
+		if stats, _ = fs.LinkStats(id, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)); len(stats) != 3 {
+			t.Errorf("%s: %v stats after a click, want 3", c.name, len(stats))
+		}
+	}
+}
+
+func TestFileStoreRetention(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "linkr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id := bson.NewObjectId()
+	old := time.Now().Add(-defaultFileStoreRetention - time.Hour)
+	err = ioutil.WriteFile(filepath.Join(dir, fileStoreStats), []byte(statsLine(id, old)+statsLine(id, time.Now())), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired stats are left out on load and dropped from the file
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := fs.LinkStats(id, old.Add(-time.Hour), time.Now().Add(time.Hour))
+	b, _ := ioutil.ReadFile(filepath.Join(dir, fileStoreStats))
+	if len(stats) != 1 || strings.Count(string(b), "\n") != 1 {
+		t.Errorf("%v stats, file\n%s", len(stats), b)
+	}
+
+	// A day on, the next click compacts the stats and checks with the next save
+	fs.Retention = time.Hour
+	fs.compactedAt = time.Now().Add(-fileStoreCompactInterval)
+	fs.RecordCheck(LinkCheckDoc{ID: bson.NewObjectId(), LinkID: id, CreatedAt: time.Now().Add(-2 * time.Hour)})
+	fs.RecordStats(LinkStatsDoc{ID: bson.NewObjectId(), LinkID: id, CreatedAt: time.Now()})
+	fs.RecordStats(LinkStatsDoc{ID: bson.NewObjectId(), LinkID: id, CreatedAt: time.Now().Add(-2 * time.Hour)})
+	err = fs.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, _ = fs.LinkStats(id, old.Add(-time.Hour), time.Now().Add(time.Hour))
+	checks, _ := fs.Checks(id, 0)
+	b, _ = ioutil.ReadFile(filepath.Join(dir, fileStoreStats))
+	c, _ := ioutil.ReadFile(filepath.Join(dir, fileStoreChecks))
+	if len(stats) != 2 || strings.Count(string(b), "\n") != 2 || len(checks) != 0 || len(c) != 0 {
+		t.Errorf("%v stats and %v checks, files\n%s\n%s", len(stats), len(checks), b, c)
+	}
+}
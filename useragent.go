@@ -0,0 +1,126 @@
+package main
+
+import "strings"
+
+// Device classes
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// UserAgent is the little we need to know about a client: browser family, OS family and device class.
+// It is not a full parser, just enough to group clicks and pick a destination.
+type UserAgent struct {
+	Browser string `json:"browser" bson:"browser"`
+	OS      string `json:"os" bson:"os"`
+	Device  string `json:"device" bson:"device"`
+}
+
+// Order matters here - many browsers claim to be others, eg Chrome says it is Safari and Edge says it is Chrome
+var browserTokens = []struct{ token, name string }{
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"edga/", "Edge"},
+	{"edgios/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"samsungbrowser", "Samsung Internet"},
+	{"ucbrowser", "UC Browser"},
+	{"yabrowser", "Yandex"},
+	{"fxios", "Firefox"},
+	{"firefox", "Firefox"},
+	{"crios", "Chrome"},
+	{"chromium", "Chromium"},
+	{"chrome", "Chrome"},
+	{"msie", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+	{"safari", "Safari"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"python", "Python"},
+	{"go-http-client", "Go"},
+}
+
+// A word token must have no letter or digit either side, so that CrOS isn't found in eg Microsoft
+var osTokens = []struct {
+	token, name string
+	word        bool
+}{
+	{"windows phone", "Windows Phone", false},
+	{"windows", "Windows", false},
+	{"iphone", "iOS", false},
+	{"ipad", "iOS", false},
+	{"ipod", "iOS", false},
+	{"android", "Android", false},
+	{"cros", "Chrome OS", true},
+	{"mac os x", "macOS", false},
+	{"macintosh", "macOS", false},
+	{"linux", "Linux", false},
+}
+
+var botTokens = []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit", "preview", "curl/", "wget/", "python", "go-http-client"}
+
+// ParseUserAgent sorts a User-Agent header into families
+func ParseUserAgent(s string) UserAgent {
+
+	ua := UserAgent{Browser: "Other", OS: "Other", Device: DeviceDesktop}
+	l := strings.ToLower(s)
+
+	if l == "" {
+		ua.Device = DeviceBot
+		return ua
+	}
+
+	for _, b := range browserTokens {
+		if strings.Contains(l, b.token) {
+			ua.Browser = b.name
+			break
+		}
+	}
+
+	for _, o := range osTokens {
+		if o.word && containsWord(l, o.token) || !o.word && strings.Contains(l, o.token) {
+			ua.OS = o.name
+			break
+		}
+	}
+
+	for _, t := range botTokens {
+		if strings.Contains(l, t) {
+			ua.Device = DeviceBot
+			return ua
+		}
+	}
+
+	// Android phones say "Mobile", Android tablets don't
+	switch {
+	case strings.Contains(l, "ipad") || strings.Contains(l, "tablet"):
+		ua.Device = DeviceTablet
+	case ua.OS == "Android" && !strings.Contains(l, "mobile"):
+		ua.Device = DeviceTablet
+	case strings.Contains(l, "mobi") || strings.Contains(l, "iphone") || strings.Contains(l, "ipod") || ua.OS == "Windows Phone":
+		ua.Device = DeviceMobile
+	}
+
+	return ua
+}
+
+// containsWord reports whether word is in s with no letter or digit either side of it
+func containsWord(s, word string) bool {
+
+	for i := 0; i+len(word) <= len(s); i++ {
+		j := strings.Index(s[i:], word)
+		if j < 0 {
+			return false
+		}
+		i += j
+		end := i + len(word)
+		if (i == 0 || !isAlnum(s[i-1])) && (end == len(s) || !isAlnum(s[end])) {
+			return true
+		}
+	}
+
+	return false
+}
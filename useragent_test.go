@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+
+	for _, c := range []struct {
+		agent string
+		want  UserAgent
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{"Chrome", "Windows", DeviceDesktop}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0",
+			UserAgent{"Edge", "Windows", DeviceDesktop}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+			UserAgent{"Safari", "macOS", DeviceDesktop}},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			UserAgent{"Firefox", "Linux", DeviceDesktop}},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{"Chrome", "Chrome OS", DeviceDesktop}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			UserAgent{"Chrome", "iOS", DeviceMobile}},
+		{"Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			UserAgent{"Safari", "iOS", DeviceTablet}},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{"Chrome", "Android", DeviceMobile}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Safari/537.36",
+			UserAgent{"Samsung Internet", "Android", DeviceTablet}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UserAgent{"Other", "Other", DeviceBot}},
+		{"curl/8.4.0", UserAgent{"curl", "Other", DeviceBot}},
+		{"", UserAgent{"Other", "Other", DeviceBot}},
+
+		// Microsoft has cros in it, but isn't Chrome OS
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Microsoft Outlook 16.80",
+			UserAgent{"Other", "macOS", DeviceDesktop}},
+		{"Microsoft Office/16.0 (Linux; Microsoft Outlook 16.0.4266)",
+			UserAgent{"Other", "Linux", DeviceDesktop}},
+		{"MicrosoftCrOS", UserAgent{"Other", "Other", DeviceDesktop}},
+	} {
+		if got := ParseUserAgent(c.agent); got != c.want {
+			t.Errorf("%.60q: %+v, want %+v", c.agent, got, c.want)
+		}
+	}
+}
+
+func TestContainsWord(t *testing.T) {
+
+	for _, c := range []struct {
+		s    string
+		want bool
+	}{
+		{"cros", true},
+		{"x11; cros x86_64", true},
+		{"(cros)", true},
+		{"microsoft", false},
+		{"microsoft cros", true},
+		{"crossing", false},
+		{"cros2", false},
+	} {
+		if got := containsWord(c.s, "cros"); got != c.want {
+			t.Errorf("%q: %v, want %v", c.s, got, c.want)
+		}
+	}
+}
+
+func TestDeviceTargets(t *testing.T) {
+
+	ld := LinkDoc{LongUrl: "https://example.org/", Targets: []TargetRule{
+		{OS: "iOS", Url: "https://apps.example.org/ios"},
+		{ID: "chromebook", OS: "chrome os", Url: "https://example.org/cros"},
+		{Device: "mobile", Url: "https://m.example.org/"},
+	}}
+	for _, c := range []struct {
+		agent, url, variant string
+	}{
+		{"Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) Safari/604.1", "https://apps.example.org/ios", "target-1"},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) Chrome/120.0.0.0", "https://example.org/cros", "chromebook"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Chrome/120.0.0.0 Mobile Safari/537.36", "https://m.example.org/", "target-3"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Microsoft Outlook 16.80", "https://example.org/", ""},
+	} {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.Header.Set("User-Agent", c.agent)
+		if url, variant := destination(httptest.NewRecorder(), r, ld); url != c.url || variant != c.variant {
+			t.Errorf("%.50q: %s, %q, want %s, %q", c.agent, url, variant, c.url, c.variant)
+		}
+	}
+}